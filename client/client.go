@@ -0,0 +1,567 @@
+// Package client talks to the cache over the text protocol
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxKeyLength is the maximum length of a key in bytes
+const maxKeyLength = 250
+
+var (
+	// ErrCacheMiss is returned when the key isn't in the cache
+	ErrCacheMiss = errors.New("memcache: cache miss")
+	// ErrNotStored is returned when the condition of an add, replace, append or prepend isn't met
+	ErrNotStored = errors.New("memcache: item not stored")
+	// ErrCASConflict is returned when the item has been changed since its cas unique was read
+	ErrCASConflict = errors.New("memcache: compare-and-swap conflict")
+	// ErrMalformedKey is returned for keys that are too long or contain spaces or control characters
+	ErrMalformedKey = errors.New("memcache: key is too long or contains invalid characters")
+	// ErrNoServers is returned by a client without servers
+	ErrNoServers = errors.New("memcache: no servers")
+)
+
+// ServerError is an ERROR, CLIENT_ERROR or SERVER_ERROR response, the connection stays usable after it
+type ServerError struct {
+	// Kind is the first word of the response
+	Kind    string
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	if e.Message == "" {
+		return "memcache: " + e.Kind
+	}
+
+	return "memcache: " + e.Kind + " " + e.Message
+}
+
+// resumable reports whether the connection is still at the start of the next response after the error
+func resumable(err error) bool {
+	var serverErr *ServerError
+
+	return err == ErrCacheMiss || err == ErrNotStored || err == ErrCASConflict || errors.As(err, &serverErr)
+}
+
+// Item is an item in the cache
+type Item struct {
+	Key   string
+	Value []byte
+	Flags uint32
+	// Expiration is the time to live in seconds, or a unix time when it is more than 30 days.
+	// 0 never expires
+	Expiration int32
+	// CAS is the cas unique returned by Get and GetMulti, it is used by CompareAndSwap
+	CAS uint64
+}
+
+// Client is a client of one or more servers, the keys are spread over the servers with a ketama Ring.
+// It is safe to use from multiple goroutines
+type Client struct {
+	ring *Ring
+	// MaxIdleConns is the amount of idle connections that are kept open to every server,
+	// DefaultMaxIdleConns when it is 0
+	MaxIdleConns int
+	// Noreply sends the storage, delete, touch and flush_all commands with noreply. The server only
+	// answers them with errors, so ErrNotStored, ErrCacheMiss and ErrCASConflict aren't reported while an
+	// error response is returned as a ServerError
+	Noreply bool
+
+	mu     sync.Mutex
+	idle   map[string][]*conn
+	closed bool
+}
+
+// New returns a client of the servers at the addresses, every server gets the same share of the keys
+func New(addrs ...string) *Client {
+	nodes := make([]Node, len(addrs))
+
+	for i, addr := range addrs {
+		nodes[i] = Node{Addr: addr, Weight: 1}
+	}
+
+	return NewWeighted(nodes...)
+}
+
+// NewWeighted returns a client of the servers of the nodes, every server gets a share of the keys
+// by its weight
+func NewWeighted(nodes ...Node) *Client {
+	return &Client{ring: NewRing(nodes...), idle: make(map[string][]*conn)}
+}
+
+// servers returns the addresses of every server in the order they were given
+func (c *Client) servers() []string {
+	nodes := c.ring.Nodes()
+	addrs := make([]string, len(nodes))
+
+	for i, node := range nodes {
+		addrs[i] = node.Addr
+	}
+
+	return addrs
+}
+
+func validKey(key string) bool {
+	if len(key) == 0 || len(key) > maxKeyLength {
+		return false
+	}
+
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+
+	return true
+}
+
+// readLine reads a response line without its \r\n
+func readLine(cn *conn) (string, error) {
+	line, err := cn.rw.ReadString('\n')
+
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+// responseError turns an error response into a ServerError, anything else is unexpected and leaves the
+// connection out of sync
+func responseError(line string) error {
+	for _, kind := range []string{"ERROR", "CLIENT_ERROR", "SERVER_ERROR"} {
+		if line == kind {
+			return &ServerError{Kind: kind}
+		}
+
+		if strings.HasPrefix(line, kind+" ") {
+			return &ServerError{Kind: kind, Message: line[len(kind)+1:]}
+		}
+	}
+
+	return fmt.Errorf("memcache: unexpected response %q", line)
+}
+
+// command writes the command line and the data block unless it is nil to the server and reads the
+// response line. With noreply the command is followed by mn, the server answers it with MN once it is
+// done with the command, so an error response in front of it is read as well
+func (c *Client) command(ctx context.Context, addr string, line string, data []byte, noreply bool) (string, error) {
+	var response string
+
+	err := c.withConn(ctx, addr, func(cn *conn) error {
+		cn.rw.WriteString(line)
+
+		if noreply {
+			cn.rw.WriteString(" noreply")
+		}
+
+		cn.rw.WriteString("\r\n")
+
+		if data != nil {
+			cn.rw.Write(data)
+			cn.rw.WriteString("\r\n")
+		}
+
+		if noreply {
+			cn.rw.WriteString("mn\r\n")
+		}
+
+		if err := cn.rw.Flush(); err != nil {
+			return err
+		}
+
+		if noreply {
+			return readNoreply(cn)
+		}
+
+		var err error
+		response, err = readLine(cn)
+
+		return err
+	})
+
+	return response, err
+}
+
+// readNoreply reads the responses up to the MN that ends a noreply command and returns the first error
+// response in front of it
+func readNoreply(cn *conn) error {
+	var err error
+
+	for {
+		line, readErr := readLine(cn)
+
+		if readErr != nil {
+			return readErr
+		}
+
+		if line == "MN" {
+			return err
+		}
+
+		if err == nil {
+			err = responseError(line)
+		}
+	}
+}
+
+// store sends a storage command, the cas unique is only sent for cas
+func (c *Client) store(ctx context.Context, verb string, item *Item) error {
+	if !validKey(item.Key) {
+		return ErrMalformedKey
+	}
+
+	line := fmt.Sprintf("%s %s %d %d %d", verb, item.Key, item.Flags, item.Expiration, len(item.Value))
+
+	if verb == "cas" {
+		line += " " + strconv.FormatUint(item.CAS, 10)
+	}
+
+	// the data block is sent even when the value is empty
+	value := item.Value
+
+	if value == nil {
+		value = []byte{}
+	}
+
+	response, err := c.command(ctx, c.ring.Get(item.Key), line, value, c.Noreply)
+
+	if err != nil || c.Noreply {
+		return err
+	}
+
+	switch response {
+	case "STORED":
+		return nil
+	case "NOT_STORED":
+		return ErrNotStored
+	case "EXISTS":
+		return ErrCASConflict
+	case "NOT_FOUND":
+		return ErrCacheMiss
+	}
+
+	return responseError(response)
+}
+
+// Set stores the item
+func (c *Client) Set(ctx context.Context, item *Item) error {
+	return c.store(ctx, "set", item)
+}
+
+// Add stores the item unless the key is already in the cache
+func (c *Client) Add(ctx context.Context, item *Item) error {
+	return c.store(ctx, "add", item)
+}
+
+// Replace stores the item only when the key is already in the cache
+func (c *Client) Replace(ctx context.Context, item *Item) error {
+	return c.store(ctx, "replace", item)
+}
+
+// Append adds the value of the item to the end of the value in the cache, the flags and expiration of
+// the item are ignored
+func (c *Client) Append(ctx context.Context, item *Item) error {
+	return c.store(ctx, "append", item)
+}
+
+// Prepend adds the value of the item to the start of the value in the cache, the flags and expiration
+// of the item are ignored
+func (c *Client) Prepend(ctx context.Context, item *Item) error {
+	return c.store(ctx, "prepend", item)
+}
+
+// CompareAndSwap stores the item only when it hasn't been changed since its cas unique was read
+func (c *Client) CompareAndSwap(ctx context.Context, item *Item) error {
+	return c.store(ctx, "cas", item)
+}
+
+// Get returns the item of the key or ErrCacheMiss
+func (c *Client) Get(ctx context.Context, key string) (*Item, error) {
+	items, err := c.GetMulti(ctx, []string{key})
+
+	if err != nil {
+		return nil, err
+	}
+
+	item, ok := items[key]
+
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+
+	return item, nil
+}
+
+// GetMulti returns the items of the keys that are in the cache, with their cas uniques. The keys of
+// every server are fetched with a single command, the servers are asked in parallel
+func (c *Client) GetMulti(ctx context.Context, keys []string) (map[string]*Item, error) {
+	byServer := make(map[string][]string)
+
+	for _, key := range keys {
+		if !validKey(key) {
+			return nil, ErrMalformedKey
+		}
+
+		addr := c.ring.Get(key)
+		byServer[addr] = append(byServer[addr], key)
+	}
+
+	items := make(map[string]*Item, len(keys))
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error
+
+	for addr, serverKeys := range byServer {
+		wg.Add(1)
+
+		go func(addr string, serverKeys []string) {
+			defer wg.Done()
+
+			found, err := c.getMulti(ctx, addr, serverKeys)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+
+			for key, item := range found {
+				items[key] = item
+			}
+		}(addr, serverKeys)
+	}
+
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	return items, nil
+}
+
+// getMulti sends a gets for the keys to the server
+func (c *Client) getMulti(ctx context.Context, addr string, keys []string) (map[string]*Item, error) {
+	items := make(map[string]*Item, len(keys))
+
+	err := c.withConn(ctx, addr, func(cn *conn) error {
+		cn.rw.WriteString("gets " + strings.Join(keys, " ") + "\r\n")
+
+		if err := cn.rw.Flush(); err != nil {
+			return err
+		}
+
+		for {
+			line, err := readLine(cn)
+
+			if err != nil {
+				return err
+			}
+
+			if line == "END" {
+				return nil
+			}
+
+			item, err := readValue(cn, line)
+
+			if err != nil {
+				return err
+			}
+
+			items[item.Key] = item
+		}
+	})
+
+	return items, err
+}
+
+// readValue reads the data block of a "VALUE <key> <flags> <bytes> <cas>" line
+func readValue(cn *conn, line string) (*Item, error) {
+	fields := strings.Fields(line)
+
+	if len(fields) != 5 || fields[0] != "VALUE" {
+		return nil, responseError(line)
+	}
+
+	flags, flagsErr := strconv.ParseUint(fields[2], 10, 32)
+	size, sizeErr := strconv.Atoi(fields[3])
+	cas, casErr := strconv.ParseUint(fields[4], 10, 64)
+
+	if flagsErr != nil || sizeErr != nil || casErr != nil || size < 0 {
+		return nil, fmt.Errorf("memcache: bad value line %q", line)
+	}
+
+	data := make([]byte, size+2)
+
+	if _, err := io.ReadFull(cn.rw, data); err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasSuffix(data, []byte("\r\n")) {
+		return nil, fmt.Errorf("memcache: bad data block for %q", fields[1])
+	}
+
+	return &Item{Key: fields[1], Value: data[:size], Flags: uint32(flags), CAS: cas}, nil
+}
+
+// Delete removes the key from the cache, it returns ErrCacheMiss when the key isn't in the cache
+func (c *Client) Delete(ctx context.Context, key string) error {
+	if !validKey(key) {
+		return ErrMalformedKey
+	}
+
+	response, err := c.command(ctx, c.ring.Get(key), "delete "+key, nil, c.Noreply)
+
+	if err != nil || c.Noreply {
+		return err
+	}
+
+	switch response {
+	case "DELETED":
+		return nil
+	case "NOT_FOUND":
+		return ErrCacheMiss
+	}
+
+	return responseError(response)
+}
+
+// Touch sets a new expiration on the key, it returns ErrCacheMiss when the key isn't in the cache
+func (c *Client) Touch(ctx context.Context, key string, expiration int32) error {
+	if !validKey(key) {
+		return ErrMalformedKey
+	}
+
+	response, err := c.command(ctx, c.ring.Get(key), fmt.Sprintf("touch %s %d", key, expiration), nil, c.Noreply)
+
+	if err != nil || c.Noreply {
+		return err
+	}
+
+	switch response {
+	case "TOUCHED":
+		return nil
+	case "NOT_FOUND":
+		return ErrCacheMiss
+	}
+
+	return responseError(response)
+}
+
+// Incr adds the delta to the decimal value of the key and returns the new value
+func (c *Client) Incr(ctx context.Context, key string, delta uint64) (uint64, error) {
+	return c.incrDecr(ctx, "incr", key, delta)
+}
+
+// Decr subtracts the delta from the decimal value of the key and returns the new value, the value
+// doesn't go below 0
+func (c *Client) Decr(ctx context.Context, key string, delta uint64) (uint64, error) {
+	return c.incrDecr(ctx, "decr", key, delta)
+}
+
+func (c *Client) incrDecr(ctx context.Context, verb string, key string, delta uint64) (uint64, error) {
+	if !validKey(key) {
+		return 0, ErrMalformedKey
+	}
+
+	response, err := c.command(ctx, c.ring.Get(key), fmt.Sprintf("%s %s %d", verb, key, delta), nil, false)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if response == "NOT_FOUND" {
+		return 0, ErrCacheMiss
+	}
+
+	value, parseErr := strconv.ParseUint(response, 10, 64)
+
+	if parseErr != nil {
+		return 0, responseError(response)
+	}
+
+	return value, nil
+}
+
+// FlushAll invalidates every item on every server
+func (c *Client) FlushAll(ctx context.Context) error {
+	for _, addr := range c.servers() {
+		response, err := c.command(ctx, addr, "flush_all", nil, c.Noreply)
+
+		if err != nil {
+			return err
+		}
+
+		if !c.Noreply && response != "OK" {
+			return responseError(response)
+		}
+	}
+
+	return nil
+}
+
+// Stats returns the general stats of every server by its address, a group like "items" or "slabs"
+// returns that group instead
+func (c *Client) Stats(ctx context.Context, group ...string) (map[string]map[string]string, error) {
+	all := make(map[string]map[string]string)
+
+	for _, addr := range c.servers() {
+		stats, err := c.serverStats(ctx, addr, group)
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", addr, err)
+		}
+
+		all[addr] = stats
+	}
+
+	return all, nil
+}
+
+func (c *Client) serverStats(ctx context.Context, addr string, group []string) (map[string]string, error) {
+	stats := make(map[string]string)
+
+	err := c.withConn(ctx, addr, func(cn *conn) error {
+		cn.rw.WriteString(strings.TrimSpace("stats "+strings.Join(group, " ")) + "\r\n")
+
+		if err := cn.rw.Flush(); err != nil {
+			return err
+		}
+
+		for {
+			line, err := readLine(cn)
+
+			if err != nil {
+				return err
+			}
+
+			if line == "END" {
+				return nil
+			}
+
+			name, value, ok := strings.Cut(strings.TrimPrefix(line, "STAT "), " ")
+
+			if !ok || !strings.HasPrefix(line, "STAT ") {
+				return responseError(line)
+			}
+
+			stats[name] = value
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,102 @@
+package client
+
+import (
+	"crypto/md5"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// ketamaPointsPerHash is the amount of points taken from every md5 digest, ketamaHashesPerServer the
+// amount of digests an average server gets, so every server is on the ring 160 times
+const (
+	ketamaPointsPerHash   = 4
+	ketamaHashesPerServer = 40
+)
+
+// Node is a server on the ring, a server with twice the weight gets about twice the keys
+type Node struct {
+	Addr   string
+	Weight int
+}
+
+// Ring places keys on servers with the consistent hashing of libketama, so adding or removing a server
+// only moves the keys of about one server. libketama puts a key on the same server as long as it is
+// given the same host:port strings and weights. Other ketama clients don't necessarily build the same
+// ring, libmemcached for one hashes servers on port 11211 without the port
+type Ring struct {
+	points []ringPoint
+	nodes  []Node
+}
+
+type ringPoint struct {
+	hash uint32
+	addr string
+}
+
+// NewRing places the nodes on the ring, nodes without a weight get a weight of 1
+func NewRing(nodes ...Node) *Ring {
+	r := &Ring{nodes: make([]Node, len(nodes))}
+
+	total := 0
+
+	for i, node := range nodes {
+		if node.Weight <= 0 {
+			node.Weight = 1
+		}
+
+		r.nodes[i] = node
+		total += node.Weight
+	}
+
+	for _, node := range r.nodes {
+		// libketama computes floorf((float)(pct * 40.0 * n)) with pct a float, so the product is a double
+		// that is rounded to a float before it is floored, the amount of points is rounded the same way
+		share := float32(node.Weight) / float32(total)
+		hashes := int(math.Floor(float64(float32(float64(share) * ketamaHashesPerServer * float64(len(r.nodes))))))
+
+		for i := 0; i < hashes; i++ {
+			digest := md5.Sum([]byte(fmt.Sprintf("%s-%d", node.Addr, i)))
+
+			for h := 0; h < ketamaPointsPerHash; h++ {
+				r.points = append(r.points, ringPoint{hash: digestPoint(digest, h), addr: node.Addr})
+			}
+		}
+	}
+
+	sort.Slice(r.points, func(i, j int) bool {
+		return r.points[i].hash < r.points[j].hash
+	})
+
+	return r
+}
+
+// digestPoint takes the h-th little endian uint32 out of the digest
+func digestPoint(digest [md5.Size]byte, h int) uint32 {
+	return uint32(digest[3+h*4])<<24 | uint32(digest[2+h*4])<<16 | uint32(digest[1+h*4])<<8 | uint32(digest[h*4])
+}
+
+// Get returns the address of the server the key is placed on, the first point on the ring at or after
+// the hash of the key
+func (r *Ring) Get(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+
+	hash := digestPoint(md5.Sum([]byte(key)), 0)
+
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= hash
+	})
+
+	if i == len(r.points) {
+		i = 0
+	}
+
+	return r.points[i].addr
+}
+
+// Nodes returns the nodes on the ring
+func (r *Ring) Nodes() []Node {
+	return append([]Node(nil), r.nodes...)
+}
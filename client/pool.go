@@ -0,0 +1,140 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"time"
+)
+
+// DefaultMaxIdleConns is the amount of idle connections a client keeps open to every server when
+// MaxIdleConns is 0
+const DefaultMaxIdleConns = 2
+
+// aLongTimeAgo is the deadline that interrupts the reads and writes of a connection whose context is done
+var aLongTimeAgo = time.Unix(1, 0)
+
+// conn is a connection to the server, it is either idle in the pool or used by a single call
+type conn struct {
+	nc net.Conn
+	rw *bufio.ReadWriter
+}
+
+// getConn takes an idle connection to the server out of the pool or dials a new one
+func (c *Client) getConn(ctx context.Context, addr string) (*conn, error) {
+	c.mu.Lock()
+
+	if n := len(c.idle[addr]); n > 0 {
+		cn := c.idle[addr][n-1]
+		c.idle[addr] = c.idle[addr][:n-1]
+		c.mu.Unlock()
+
+		return cn, nil
+	}
+
+	c.mu.Unlock()
+
+	var dialer net.Dialer
+
+	nc, err := dialer.DialContext(ctx, "tcp", addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &conn{nc: nc, rw: bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))}, nil
+}
+
+// putConn returns the connection to the pool of the server, it is closed when the pool is full
+func (c *Client) putConn(addr string, cn *conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	maxIdle := c.MaxIdleConns
+
+	if maxIdle == 0 {
+		maxIdle = DefaultMaxIdleConns
+	}
+
+	if c.closed || len(c.idle[addr]) >= maxIdle {
+		cn.nc.Close()
+		return
+	}
+
+	c.idle[addr] = append(c.idle[addr], cn)
+}
+
+// withConn runs the call on a connection to the server. The deadline of the context is the deadline of
+// the connection and cancelling the context interrupts the call, the connection only goes back to the
+// pool when the call left it at the start of the next response
+func (c *Client) withConn(ctx context.Context, addr string, call func(*conn) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if addr == "" {
+		return ErrNoServers
+	}
+
+	cn, err := c.getConn(ctx, addr)
+
+	if err != nil {
+		return err
+	}
+
+	deadline, _ := ctx.Deadline()
+	cn.nc.SetDeadline(deadline)
+
+	stop := context.AfterFunc(ctx, func() {
+		cn.nc.SetDeadline(aLongTimeAgo)
+	})
+
+	err = call(cn)
+
+	// a connection that was interrupted may have a late response on its way, so it isn't reused
+	if interrupted := !stop(); interrupted || err != nil && !resumable(err) {
+		cn.nc.Close()
+
+		if err == nil {
+			return nil
+		}
+
+		return contextError(ctx, deadline, err)
+	}
+
+	c.putConn(addr, cn)
+
+	return err
+}
+
+// contextError returns the error of the context when the call failed because the context is done, the
+// deadline of the connection can pass a moment before the context notices
+func contextError(ctx context.Context, deadline time.Time, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+
+	return err
+}
+
+// Close closes the idle connections, the connections that are in use are closed once their call returns
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+
+	for _, idle := range c.idle {
+		for _, cn := range idle {
+			cn.nc.Close()
+		}
+	}
+
+	c.idle = nil
+
+	return nil
+}
@@ -0,0 +1,428 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pschlafley/coding-challenges/go-memcache/client"
+	"github.com/pschlafley/coding-challenges/go-memcache/server"
+)
+
+// startTestServer starts a server on an ephemeral port and returns its address
+func startTestServer(t *testing.T) string {
+	s := server.NewServer("127.0.0.1:0")
+
+	ln, err := net.Listen("tcp", s.ListenAddr)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Listener = ln
+
+	go func() {
+		for range s.MsgCh {
+		}
+	}()
+
+	go s.AcceptConnections()
+
+	return ln.Addr().String()
+}
+
+func newTestClient(t *testing.T) *client.Client {
+	c := client.New(startTestServer(t))
+
+	t.Cleanup(func() { c.Close() })
+
+	return c
+}
+
+// onlyServer returns the stats of the single server of the client
+func onlyServer(t *testing.T, all map[string]map[string]string) map[string]string {
+	t.Helper()
+
+	if len(all) != 1 {
+		t.Fatalf("expected: the stats of 1 server, got: %d", len(all))
+	}
+
+	for _, stats := range all {
+		return stats
+	}
+
+	return nil
+}
+
+func expectValue(t *testing.T, c *client.Client, key string, value string) *client.Item {
+	t.Helper()
+
+	item, err := c.Get(context.Background(), key)
+
+	if err != nil {
+		t.Fatalf("get %s: %v", key, err)
+	}
+
+	if !bytes.Equal(item.Value, []byte(value)) {
+		t.Fatalf("expected: %q for %s, got: %q", value, key, item.Value)
+	}
+
+	return item
+}
+
+func TestStorageCommands(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	if err := c.Set(ctx, &client.Item{Key: "a", Value: []byte("hello"), Flags: 7}); err != nil {
+		t.Fatal(err)
+	}
+
+	if item := expectValue(t, c, "a", "hello"); item.Flags != 7 {
+		t.Fatalf("expected: flags 7, got: %d", item.Flags)
+	}
+
+	if err := c.Add(ctx, &client.Item{Key: "a", Value: []byte("x")}); err != client.ErrNotStored {
+		t.Fatalf("expected: ErrNotStored for an add of an existing key, got: %v", err)
+	}
+
+	if err := c.Replace(ctx, &client.Item{Key: "missing", Value: []byte("x")}); err != client.ErrNotStored {
+		t.Fatalf("expected: ErrNotStored for a replace of a missing key, got: %v", err)
+	}
+
+	if err := c.Append(ctx, &client.Item{Key: "a", Value: []byte(" world")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Prepend(ctx, &client.Item{Key: "a", Value: []byte("> ")}); err != nil {
+		t.Fatal(err)
+	}
+
+	expectValue(t, c, "a", "> hello world")
+
+	// values with \r\n in them are framed by their byte count
+	if err := c.Set(ctx, &client.Item{Key: "crlf", Value: []byte("a\r\nb")}); err != nil {
+		t.Fatal(err)
+	}
+
+	expectValue(t, c, "crlf", "a\r\nb")
+
+	if err := c.Set(ctx, &client.Item{Key: "empty"}); err != nil {
+		t.Fatal(err)
+	}
+
+	expectValue(t, c, "empty", "")
+
+	if err := c.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Get(ctx, "a"); err != client.ErrCacheMiss {
+		t.Fatalf("expected: ErrCacheMiss after the delete, got: %v", err)
+	}
+
+	if err := c.Delete(ctx, "a"); err != client.ErrCacheMiss {
+		t.Fatalf("expected: ErrCacheMiss for a delete of a missing key, got: %v", err)
+	}
+
+	if err := c.Set(ctx, &client.Item{Key: "bad key", Value: []byte("x")}); err != client.ErrMalformedKey {
+		t.Fatalf("expected: ErrMalformedKey, got: %v", err)
+	}
+}
+
+func TestGetMulti(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := c.Set(ctx, &client.Item{Key: key, Value: []byte("value " + key)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	items, err := c.GetMulti(ctx, []string{"a", "missing", "c"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(items) != 2 || string(items["a"].Value) != "value a" || string(items["c"].Value) != "value c" {
+		t.Fatalf("expected: a and c, got: %v", items)
+	}
+}
+
+func TestIncrDecrAndTouch(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	if _, err := c.Incr(ctx, "n", 1); err != client.ErrCacheMiss {
+		t.Fatalf("expected: ErrCacheMiss for a missing counter, got: %v", err)
+	}
+
+	if err := c.Set(ctx, &client.Item{Key: "n", Value: []byte("10")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := c.Incr(ctx, "n", 5); err != nil || n != 15 {
+		t.Fatalf("expected: 15, got: %d %v", n, err)
+	}
+
+	if n, err := c.Decr(ctx, "n", 20); err != nil || n != 0 {
+		t.Fatalf("expected: 0, got: %d %v", n, err)
+	}
+
+	if err := c.Set(ctx, &client.Item{Key: "text", Value: []byte("abc")}); err != nil {
+		t.Fatal(err)
+	}
+
+	var serverErr *client.ServerError
+
+	if _, err := c.Incr(ctx, "text", 1); !errors.As(err, &serverErr) || serverErr.Kind != "CLIENT_ERROR" {
+		t.Fatalf("expected: a CLIENT_ERROR for a non-numeric value, got: %v", err)
+	}
+
+	if err := c.Touch(ctx, "n", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Touch(ctx, "missing", 1); err != client.ErrCacheMiss {
+		t.Fatalf("expected: ErrCacheMiss for a touch of a missing key, got: %v", err)
+	}
+
+	time.Sleep(2100 * time.Millisecond)
+
+	if _, err := c.Get(ctx, "n"); err != client.ErrCacheMiss {
+		t.Fatalf("expected: the touched item to expire, got: %v", err)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	if err := c.Set(ctx, &client.Item{Key: "a", Value: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	item := expectValue(t, c, "a", "1")
+
+	if err := c.Set(ctx, &client.Item{Key: "a", Value: []byte("2")}); err != nil {
+		t.Fatal(err)
+	}
+
+	item.Value = []byte("3")
+
+	if err := c.CompareAndSwap(ctx, item); err != client.ErrCASConflict {
+		t.Fatalf("expected: ErrCASConflict after the item changed, got: %v", err)
+	}
+
+	item = expectValue(t, c, "a", "2")
+	item.Value = []byte("3")
+
+	if err := c.CompareAndSwap(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+
+	expectValue(t, c, "a", "3")
+
+	if err := c.CompareAndSwap(ctx, &client.Item{Key: "missing", Value: []byte("x"), CAS: 1}); err != client.ErrCacheMiss {
+		t.Fatalf("expected: ErrCacheMiss for a cas of a missing key, got: %v", err)
+	}
+}
+
+func TestFlushAllAndStats(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if err := c.Set(ctx, &client.Item{Key: fmt.Sprint(i), Value: []byte("x")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	all, err := c.Stats(ctx)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats := onlyServer(t, all)
+
+	if stats["curr_items"] != "3" || stats["cmd_set"] != "3" {
+		t.Fatalf("expected: 3 items and sets, got: %v", stats)
+	}
+
+	if err := c.FlushAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Get(ctx, "0"); err != client.ErrCacheMiss {
+		t.Fatalf("expected: ErrCacheMiss after flush_all, got: %v", err)
+	}
+
+	all, err = c.Stats(ctx, "settings")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if settings := onlyServer(t, all); settings["cas_enabled"] != "yes" {
+		t.Fatalf("expected: the settings group, got: %v", settings)
+	}
+
+	var serverErr *client.ServerError
+
+	if _, err := c.Stats(ctx, "nonsense"); !errors.As(err, &serverErr) || serverErr.Kind != "ERROR" {
+		t.Fatalf("expected: ERROR for an unknown group, got: %v", err)
+	}
+}
+
+func TestNoreply(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	c.Noreply = true
+
+	if err := c.Set(ctx, &client.Item{Key: "a", Value: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the failed add isn't answered, so the next command still reads its own response
+	if err := c.Add(ctx, &client.Item{Key: "a", Value: []byte("2")}); err != nil {
+		t.Fatal(err)
+	}
+
+	expectValue(t, c, "a", "1")
+}
+
+func TestNoreplyErrorKeepsConnectionInSync(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	c.Noreply = true
+
+	// the server answers the value that is too large for it even with noreply
+	var serverErr *client.ServerError
+
+	if err := c.Set(ctx, &client.Item{Key: "large", Value: make([]byte, 1024*1024)}); !errors.As(err, &serverErr) || serverErr.Kind != "SERVER_ERROR" {
+		t.Fatalf("expected: a SERVER_ERROR for the large value, got: %v", err)
+	}
+
+	if err := c.Set(ctx, &client.Item{Key: "a", Value: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Delete(ctx, "missing"); err != nil {
+		t.Fatal(err)
+	}
+
+	expectValue(t, c, "a", "1")
+
+	if n, err := c.Incr(ctx, "a", 1); err != nil || n != 2 {
+		t.Fatalf("expected: 2, got: %d, %v", n, err)
+	}
+
+	all, err := c.Stats(ctx)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats := onlyServer(t, all); stats["total_connections"] != "1" {
+		t.Fatalf("expected: the connection to be reused after the error, got: %s", stats["total_connections"])
+	}
+}
+
+func TestConnectionsArePooled(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	for i := 0; i < 20; i++ {
+		if err := c.Set(ctx, &client.Item{Key: "a", Value: []byte("x")}); err != nil {
+			t.Fatal(err)
+		}
+
+		// error responses leave the connection usable
+		if _, err := c.Get(ctx, "missing"); err != client.ErrCacheMiss {
+			t.Fatal(err)
+		}
+	}
+
+	all, err := c.Stats(ctx)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats := onlyServer(t, all); stats["total_connections"] != "1" {
+		t.Fatalf("expected: a single connection for sequential calls, got: %s", stats["total_connections"])
+	}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			key := fmt.Sprint("k", i)
+
+			if err := c.Set(ctx, &client.Item{Key: key, Value: []byte(key)}); err != nil {
+				t.Error(err)
+				return
+			}
+
+			if item, err := c.Get(ctx, key); err != nil || string(item.Value) != key {
+				t.Errorf("expected: %s, got: %v %v", key, item, err)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+func TestContextCancellation(t *testing.T) {
+	// a listener that never answers
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+
+			if err != nil {
+				return
+			}
+
+			defer conn.Close()
+		}
+	}()
+
+	c := client.New(ln.Addr().String())
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if _, err := c.Get(ctx, "a"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected: the deadline of the context, got: %v", err)
+	}
+
+	cancelled, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+
+	if err := c.Set(cancelled, &client.Item{Key: "a"}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected: the cancelled context, got: %v", err)
+	}
+}
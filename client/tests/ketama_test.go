@@ -0,0 +1,215 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/pschlafley/coding-challenges/go-memcache/client"
+)
+
+// placeKeys counts the keys every server of the ring gets
+func placeKeys(ring *client.Ring, keys int) map[string]int {
+	counts := make(map[string]int)
+
+	for i := 0; i < keys; i++ {
+		counts[ring.Get(fmt.Sprint("key", i))]++
+	}
+
+	return counts
+}
+
+func TestRingSpreadsKeys(t *testing.T) {
+	ring := client.NewRing(
+		client.Node{Addr: "10.0.0.1:11211"},
+		client.Node{Addr: "10.0.0.2:11211"},
+		client.Node{Addr: "10.0.0.3:11211"},
+		client.Node{Addr: "10.0.0.4:11211"},
+	)
+
+	for addr, count := range placeKeys(ring, 10000) {
+		if count < 1750 || count > 3250 {
+			t.Fatalf("expected: about 2500 keys on %s, got: %d", addr, count)
+		}
+	}
+}
+
+func TestRingWeights(t *testing.T) {
+	ring := client.NewRing(
+		client.Node{Addr: "10.0.0.1:11211", Weight: 1},
+		client.Node{Addr: "10.0.0.2:11211", Weight: 3},
+	)
+
+	counts := placeKeys(ring, 10000)
+
+	if light, heavy := counts["10.0.0.1:11211"], counts["10.0.0.2:11211"]; heavy < 2*light || heavy > 4*light {
+		t.Fatalf("expected: about 3 times the keys on the heavier node, got: %d and %d", light, heavy)
+	}
+}
+
+func TestAddingANodeOnlyMovesItsShare(t *testing.T) {
+	nodes := []client.Node{
+		{Addr: "10.0.0.1:11211"},
+		{Addr: "10.0.0.2:11211"},
+		{Addr: "10.0.0.3:11211"},
+		{Addr: "10.0.0.4:11211"},
+	}
+
+	before := client.NewRing(nodes...)
+	after := client.NewRing(append(nodes, client.Node{Addr: "10.0.0.5:11211"})...)
+
+	moved := 0
+
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprint("key", i)
+
+		if from, to := before.Get(key), after.Get(key); from != to {
+			if to != "10.0.0.5:11211" {
+				t.Fatalf("expected: %s to only move to the new node, it moved from %s to %s", key, from, to)
+			}
+
+			moved++
+		}
+	}
+
+	// the new node takes about a fifth of the keys
+	if moved < 1250 || moved > 2750 {
+		t.Fatalf("expected: about 2000 keys to move, got: %d", moved)
+	}
+}
+
+func TestRingIsStable(t *testing.T) {
+	nodes := []client.Node{{Addr: "a:11211"}, {Addr: "b:11211"}, {Addr: "c:11211"}}
+	reversed := []client.Node{nodes[2], nodes[1], nodes[0]}
+
+	first, second := client.NewRing(nodes...), client.NewRing(reversed...)
+
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i)
+
+		if first.Get(key) != second.Get(key) {
+			t.Fatalf("expected: %s on the same node regardless of the order of the nodes", key)
+		}
+	}
+
+	if addr := client.NewRing().Get("key"); addr != "" {
+		t.Fatalf("expected: no node on an empty ring, got: %s", addr)
+	}
+}
+
+// TestRingMatchesLibketama checks the servers of keys against the ones libketama picks for the same
+// servers and weights. The keys 346, 434, 696 and 807 land on the points the first server would get
+// if the amount of points was computed in float32 only
+func TestRingMatchesLibketama(t *testing.T) {
+	for _, tc := range []struct {
+		weights []int
+		keys    map[string]string
+	}{
+		{
+			weights: []int{1, 1, 1},
+			keys: map[string]string{
+				"key0": "10.0.1.1:11211",
+				"key1": "10.0.1.2:11211",
+				"key2": "10.0.1.1:11211",
+				"key3": "10.0.1.1:11211",
+				"key4": "10.0.1.2:11211",
+				"key5": "10.0.1.3:11211",
+				"key6": "10.0.1.1:11211",
+				"key7": "10.0.1.3:11211",
+			},
+		},
+		{
+			weights: []int{42, 19, 19},
+			keys: map[string]string{
+				"key0":   "10.0.1.1:11211",
+				"key1":   "10.0.1.2:11211",
+				"key5":   "10.0.1.1:11211",
+				"key7":   "10.0.1.3:11211",
+				"key346": "10.0.1.3:11211",
+				"key434": "10.0.1.3:11211",
+				"key696": "10.0.1.2:11211",
+				"key807": "10.0.1.3:11211",
+			},
+		},
+		{
+			weights: []int{58, 1, 1},
+			keys: map[string]string{
+				"key0":   "10.0.1.1:11211",
+				"key28":  "10.0.1.3:11211",
+				"key36":  "10.0.1.2:11211",
+				"key50":  "10.0.1.2:11211",
+				"key76":  "10.0.1.3:11211",
+				"key165": "10.0.1.2:11211",
+				"key249": "10.0.1.3:11211",
+			},
+		},
+	} {
+		nodes := make([]client.Node, len(tc.weights))
+
+		for i, weight := range tc.weights {
+			nodes[i] = client.Node{Addr: fmt.Sprintf("10.0.1.%d:11211", i+1), Weight: weight}
+		}
+
+		ring := client.NewRing(nodes...)
+
+		for key, addr := range tc.keys {
+			if got := ring.Get(key); got != addr {
+				t.Fatalf("weights %v: expected: %s on %s, got: %s", tc.weights, key, addr, got)
+			}
+		}
+	}
+}
+
+func TestClientShardsKeysOverServers(t *testing.T) {
+	first, second := startTestServer(t), startTestServer(t)
+
+	c := client.New(first, second)
+	defer c.Close()
+
+	ctx := context.Background()
+	keys := make([]string, 50)
+
+	for i := range keys {
+		keys[i] = fmt.Sprint("key", i)
+
+		if err := c.Set(ctx, &client.Item{Key: keys[i], Value: []byte(keys[i])}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	items, err := c.GetMulti(ctx, keys)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(items) != len(keys) {
+		t.Fatalf("expected: %d items, got: %d", len(keys), len(items))
+	}
+
+	stats, err := c.Stats(ctx)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	firstItems, _ := strconv.Atoi(stats[first]["curr_items"])
+	secondItems, _ := strconv.Atoi(stats[second]["curr_items"])
+
+	if firstItems == 0 || secondItems == 0 || firstItems+secondItems != len(keys) {
+		t.Fatalf("expected: the keys spread over both servers, got: %d and %d", firstItems, secondItems)
+	}
+
+	if err := c.FlushAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if items, err := c.GetMulti(ctx, keys); err != nil || len(items) != 0 {
+		t.Fatalf("expected: flush_all on every server, got: %d items %v", len(items), err)
+	}
+
+	if _, err := client.New().Get(ctx, "key"); err != client.ErrNoServers {
+		t.Fatalf("expected: ErrNoServers, got: %v", err)
+	}
+}
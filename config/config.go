@@ -0,0 +1,334 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pschlafley/coding-challenges/go-memcache/server"
+	"github.com/pschlafley/coding-challenges/go-memcache/types"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is put in front of the upper cased yaml key of a setting to get its environment variable,
+// GO_MEMCACHED_CONFIG names the config file when -config isn't given
+const EnvPrefix = "GO_MEMCACHED_"
+
+// Config holds the settings of the server. They start out as the defaults and are overridden by the
+// YAML file given with -config, then by the environment variables and last by the flags
+type Config struct {
+	ListenAddr string `yaml:"listen_addr"`
+	Port       int    `yaml:"port"`
+	// MemoryLimit is in megabytes
+	MemoryLimit int64 `yaml:"memory_limit"`
+	MaxConns    int   `yaml:"max_connections"`
+	// ItemSizeMax is in bytes
+	ItemSizeMax     int64         `yaml:"item_size_max"`
+	GrowthFactor    float64       `yaml:"growth_factor"`
+	ChunkSize       int           `yaml:"chunk_size"`
+	Shards          int           `yaml:"shards"`
+	EvictionPolicy  string        `yaml:"eviction_policy"`
+	CrawlerInterval time.Duration `yaml:"crawler_interval"`
+	LogPath         string        `yaml:"log_path"`
+	// LogLevel is the verbosity the server starts with, 0 turns the command log off
+	LogLevel           int           `yaml:"log_level"`
+	SnapshotFile       string        `yaml:"snapshot_file"`
+	SnapshotInterval   time.Duration `yaml:"snapshot_interval"`
+	Restore            bool          `yaml:"restore"`
+	SnapshotOnShutdown bool          `yaml:"snapshot_on_shutdown"`
+	ShutdownTimeout    time.Duration `yaml:"shutdown_timeout"`
+	OpLog              string        `yaml:"oplog"`
+	OpLogFsync         string        `yaml:"oplog_fsync"`
+	ReplicaOf          string        `yaml:"replicaof"`
+	ReplBacklog        int           `yaml:"repl_backlog"`
+}
+
+// Default returns the settings the server runs with when nothing is configured
+func Default() *Config {
+	return &Config{
+		ListenAddr:      "127.0.0.1",
+		Port:            11211,
+		MemoryLimit:     server.DefaultMaxBytes / 1024 / 1024,
+		MaxConns:        server.DefaultMaxConns,
+		ItemSizeMax:     types.MaxItemSize,
+		GrowthFactor:    server.DefaultGrowthFactor,
+		ChunkSize:       server.DefaultChunkSize,
+		Shards:          server.DefaultShards,
+		EvictionPolicy:  types.EvictLRU,
+		CrawlerInterval: server.DefaultCrawlerInterval,
+		LogPath:         server.DefaultLogPath,
+		LogLevel:        1,
+		SnapshotFile:    server.DefaultSnapshotPath,
+		ShutdownTimeout: server.DefaultShutdownTimeout,
+		OpLogFsync:      server.FsyncEverySec,
+		ReplBacklog:     server.DefaultReplBacklogSize,
+	}
+}
+
+// RegisterFlags defines a flag for every setting on the flag set, the flags write into c
+func RegisterFlags(fs *flag.FlagSet, c *Config) {
+	fs.StringVar(&c.ListenAddr, "l", c.ListenAddr, "Enter in the address the tcp server listens on, empty listens on every interface")
+	fs.IntVar(&c.Port, "p", c.Port, "Enter in the port you want to bind the tcp server to")
+	fs.Int64Var(&c.MemoryLimit, "m", c.MemoryLimit, "Enter in the memory limit of the cache in megabytes")
+	fs.IntVar(&c.MaxConns, "c", c.MaxConns, "Enter in the amount of connections served at once")
+	fs.Int64Var(&c.ItemSizeMax, "I", c.ItemSizeMax, "Enter in the size in bytes of the largest item the cache takes")
+	fs.Float64Var(&c.GrowthFactor, "f", c.GrowthFactor, "Enter in the growth factor between the chunk sizes of the slab classes")
+	fs.IntVar(&c.ChunkSize, "n", c.ChunkSize, "Enter in the space for the key and value in the smallest slab class")
+	fs.IntVar(&c.Shards, "shards", c.Shards, "Enter in the amount of shards the cache is split into")
+	fs.StringVar(&c.EvictionPolicy, "eviction-policy", c.EvictionPolicy, "Enter in what happens when the memory limit is reached: lru evicts the least recently used items, none fails the write")
+	fs.DurationVar(&c.CrawlerInterval, "crawler-interval", c.CrawlerInterval, "Enter in the time between two sweeps of the expiry crawler")
+	fs.StringVar(&c.LogPath, "log-path", c.LogPath, "Enter in the file the commands are logged to")
+	fs.IntVar(&c.LogLevel, "log-level", c.LogLevel, "Enter in the verbosity the server starts with, 0 turns the command log off")
+	fs.StringVar(&c.SnapshotFile, "snapshot-file", c.SnapshotFile, "Enter in the file the snapshots are written to and restored from")
+	fs.DurationVar(&c.SnapshotInterval, "snapshot-interval", c.SnapshotInterval, "Enter in the time between two snapshots, 0 only takes them with the snapshot command")
+	fs.BoolVar(&c.Restore, "restore", c.Restore, "Restore the items of the snapshot file on startup")
+	fs.BoolVar(&c.SnapshotOnShutdown, "snapshot-on-shutdown", c.SnapshotOnShutdown, "Write a snapshot when the server shuts down")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "Enter in the time running commands get to finish when the server shuts down")
+	fs.StringVar(&c.OpLog, "oplog", c.OpLog, "Enter in the file every mutation is logged to and replayed from on startup, empty turns the log off")
+	fs.StringVar(&c.OpLogFsync, "oplog-fsync", c.OpLogFsync, "Enter in when the operation log is synced to disk: always, everysec or never")
+	fs.StringVar(&c.ReplicaOf, "replicaof", c.ReplicaOf, "Enter in the host:port of the primary to run as its read-only replica")
+	fs.IntVar(&c.ReplBacklog, "repl-backlog", c.ReplBacklog, "Enter in the size in bytes of the backlog replicas resume from after a disconnect")
+}
+
+// Parse builds the configuration out of the command line arguments. The flags are parsed twice: once
+// to find the config file and once more on top of the file and the environment, so only the flags that
+// were given override them. lookupEnv is os.LookupEnv outside of tests
+func Parse(fs *flag.FlagSet, args []string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	var path string
+
+	fs.StringVar(&path, "config", "", "Enter in the YAML file the settings are loaded from, the flags and environment variables override it")
+	RegisterFlags(fs, Default())
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if path == "" {
+		path, _ = lookupEnv(EnvPrefix + "CONFIG")
+	}
+
+	c := Default()
+
+	if path != "" {
+		if err := c.LoadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.ApplyEnv(lookupEnv); err != nil {
+		return nil, err
+	}
+
+	overrides := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	overrides.SetOutput(io.Discard)
+	overrides.String("config", "", "")
+	RegisterFlags(overrides, c)
+
+	if err := overrides.Parse(args); err != nil {
+		return nil, err
+	}
+
+	return c, c.Validate()
+}
+
+// LoadFile overrides the settings with the ones in the YAML file, settings that aren't in the file
+// keep their value and unknown keys are an error
+func (c *Config) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	// an empty file leaves every setting alone
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// ApplyEnv overrides the settings with the environment variables that are set, GO_MEMCACHED_PORT sets
+// port and so on
+func (c *Config) ApplyEnv(lookupEnv func(string) (string, bool)) error {
+	v := reflect.ValueOf(c).Elem()
+
+	for i := 0; i < v.NumField(); i++ {
+		name := EnvPrefix + strings.ToUpper(v.Type().Field(i).Tag.Get("yaml"))
+		value, ok := lookupEnv(name)
+
+		if !ok {
+			continue
+		}
+
+		if err := setField(v.Field(i), value); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// setField parses the value of an environment variable into the field
+func setField(field reflect.Value, value string) error {
+	if field.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(value)
+
+		if err != nil {
+			return fmt.Errorf("invalid duration %q, use a number with a unit like 30s", value)
+		}
+
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+
+		field.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+
+		if err != nil {
+			return fmt.Errorf("invalid number %q", value)
+		}
+
+		field.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q, use true or false", value)
+		}
+
+		field.SetBool(b)
+	}
+
+	return nil
+}
+
+// Validate checks every setting and returns all the problems at once, each names the yaml key and the
+// flag of the setting
+func (c *Config) Validate() error {
+	var errs []error
+
+	invalid := func(key string, flag string, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s (-%s): %s", key, flag, fmt.Sprintf(format, args...)))
+	}
+
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err == nil {
+		invalid("listen_addr", "l", "%q has a port in it, the port is set with port", c.ListenAddr)
+	}
+
+	if c.Port < 1 || c.Port > 65535 {
+		invalid("port", "p", "has to be between 1 and 65535, got %d", c.Port)
+	}
+
+	if c.MemoryLimit < 1 {
+		invalid("memory_limit", "m", "has to be at least 1 megabyte, got %d", c.MemoryLimit)
+	}
+
+	if c.MaxConns < 1 {
+		invalid("max_connections", "c", "has to be at least 1, got %d", c.MaxConns)
+	}
+
+	if c.ItemSizeMax < 1024 || c.ItemSizeMax > types.MaxItemSize {
+		invalid("item_size_max", "I", "has to be between 1024 and %d bytes, got %d", types.MaxItemSize, c.ItemSizeMax)
+	}
+
+	if c.GrowthFactor <= 1 {
+		invalid("growth_factor", "f", "has to be larger than 1, got %v", c.GrowthFactor)
+	}
+
+	if c.ChunkSize < 1 {
+		invalid("chunk_size", "n", "has to be at least 1 byte, got %d", c.ChunkSize)
+	}
+
+	if c.Shards < 1 {
+		invalid("shards", "shards", "the cache needs at least 1 shard, got %d", c.Shards)
+	}
+
+	// every shard evicts within its own share of the memory limit, so the largest item has to fit into it
+	if share := c.MemoryLimit * 1024 * 1024 / int64(max(c.Shards, 1)); c.MemoryLimit >= 1 && share < c.ItemSizeMax {
+		invalid("memory_limit", "m", "every one of the %d shards gets %d bytes, which is less than the item_size_max of %d bytes, raise memory_limit or lower shards or item_size_max", c.Shards, share, c.ItemSizeMax)
+	}
+
+	if c.EvictionPolicy != types.EvictLRU && c.EvictionPolicy != types.EvictNone {
+		invalid("eviction_policy", "eviction-policy", "has to be %s or %s, got %q", types.EvictLRU, types.EvictNone, c.EvictionPolicy)
+	}
+
+	if c.CrawlerInterval <= 0 {
+		invalid("crawler_interval", "crawler-interval", "has to be positive, got %v", c.CrawlerInterval)
+	}
+
+	if c.LogPath == "" {
+		invalid("log_path", "log-path", "can't be empty")
+	}
+
+	if c.LogLevel < 0 {
+		invalid("log_level", "log-level", "can't be negative, got %d", c.LogLevel)
+	}
+
+	if c.SnapshotFile == "" {
+		invalid("snapshot_file", "snapshot-file", "can't be empty")
+	}
+
+	if c.SnapshotInterval < 0 {
+		invalid("snapshot_interval", "snapshot-interval", "can't be negative, got %v", c.SnapshotInterval)
+	}
+
+	if c.ShutdownTimeout < 0 {
+		invalid("shutdown_timeout", "shutdown-timeout", "can't be negative, got %v", c.ShutdownTimeout)
+	}
+
+	switch c.OpLogFsync {
+	case server.FsyncAlways, server.FsyncEverySec, server.FsyncNever:
+	default:
+		invalid("oplog_fsync", "oplog-fsync", "has to be %s, %s or %s, got %q", server.FsyncAlways, server.FsyncEverySec, server.FsyncNever, c.OpLogFsync)
+	}
+
+	if _, _, err := net.SplitHostPort(c.ReplicaOf); c.ReplicaOf != "" && err != nil {
+		invalid("replicaof", "replicaof", "has to be host:port, got %q", c.ReplicaOf)
+	}
+
+	if c.ReplBacklog < 1 {
+		invalid("repl_backlog", "repl-backlog", "has to be at least 1 byte, got %d", c.ReplBacklog)
+	}
+
+	return errors.Join(errs...)
+}
+
+// Address is the host:port the server listens on
+func (c *Config) Address() string {
+	return net.JoinHostPort(c.ListenAddr, strconv.Itoa(c.Port))
+}
+
+// StoreConfig is the configuration of the store the settings describe
+func (c *Config) StoreConfig() types.StoreConfig {
+	return types.StoreConfig{
+		MaxBytes:       c.MemoryLimit * 1024 * 1024,
+		Factor:         c.GrowthFactor,
+		ChunkSize:      c.ChunkSize,
+		Shards:         c.Shards,
+		ItemSizeMax:    c.ItemSizeMax,
+		EvictionPolicy: c.EvictionPolicy,
+	}
+}
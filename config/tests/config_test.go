@@ -0,0 +1,181 @@
+package config
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pschlafley/coding-challenges/go-memcache/config"
+	"github.com/pschlafley/coding-challenges/go-memcache/types"
+)
+
+// writeConfig writes the YAML into a config file and returns its path
+func writeConfig(t *testing.T, yaml string) string {
+	path := filepath.Join(t.TempDir(), "memcached.yaml")
+
+	if err := os.WriteFile(path, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// parse parses the arguments with the given environment
+func parse(env map[string]string, args ...string) (*config.Config, error) {
+	fs := flag.NewFlagSet("go-memcached", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+
+	return config.Parse(fs, args, func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	})
+}
+
+func TestDefaults(t *testing.T) {
+	c, err := parse(nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Address() != "127.0.0.1:11211" || c.MemoryLimit != 64 || c.EvictionPolicy != types.EvictLRU {
+		t.Fatalf("expected: the defaults, got: %+v", c)
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	path := writeConfig(t, `
+listen_addr: 0.0.0.0
+port: 11300
+memory_limit: 128
+max_connections: 64
+item_size_max: 4096
+log_path: /var/log/memcached.log
+log_level: 2
+eviction_policy: none
+crawler_interval: 15s
+`)
+
+	c, err := parse(nil, "-config", path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Address() != "0.0.0.0:11300" || c.MemoryLimit != 128 || c.MaxConns != 64 || c.ItemSizeMax != 4096 {
+		t.Fatalf("expected: the settings of the file, got: %+v", c)
+	}
+
+	if c.LogPath != "/var/log/memcached.log" || c.LogLevel != 2 || c.EvictionPolicy != types.EvictNone || c.CrawlerInterval != 15*time.Second {
+		t.Fatalf("expected: the settings of the file, got: %+v", c)
+	}
+
+	// settings that aren't in the file keep their default
+	if c.Shards != 16 {
+		t.Fatalf("expected: the default amount of shards, got: %d", c.Shards)
+	}
+
+	store := c.StoreConfig()
+
+	if store.MaxBytes != 128*1024*1024 || store.ItemSizeMax != 4096 || store.EvictionPolicy != types.EvictNone {
+		t.Fatalf("expected: the store to get the settings, got: %+v", store)
+	}
+}
+
+func TestEnvAndFlagsOverrideTheFile(t *testing.T) {
+	path := writeConfig(t, "port: 11300\nmemory_limit: 128\nmax_connections: 64\n")
+
+	env := map[string]string{
+		"GO_MEMCACHED_CONFIG":       path,
+		"GO_MEMCACHED_MEMORY_LIMIT": "256",
+		"GO_MEMCACHED_PORT":         "11400",
+	}
+
+	c, err := parse(env, "-p", "11500")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the flag beats the environment, which beats the file
+	if c.Port != 11500 || c.MemoryLimit != 256 || c.MaxConns != 64 {
+		t.Fatalf("expected: port from the flag, memory from the env and connections from the file, got: %+v", c)
+	}
+
+	// a flag that is set to its default still overrides the file
+	c, err = parse(nil, "-config", path, "-m", "64")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.MemoryLimit != 64 || c.Port != 11300 {
+		t.Fatalf("expected: the memory limit of the flag, got: %+v", c)
+	}
+}
+
+func TestInvalidSettings(t *testing.T) {
+	path := writeConfig(t, "port: 70000\nmemory_limit: 0\neviction_policy: random\n")
+
+	_, err := parse(nil, "-config", path, "-crawler-interval", "0s")
+
+	if err == nil {
+		t.Fatal("expected: the invalid settings to be reported")
+	}
+
+	for _, expected := range []string{
+		"port (-p): has to be between 1 and 65535, got 70000",
+		"memory_limit (-m): has to be at least 1 megabyte, got 0",
+		`eviction_policy (-eviction-policy): has to be lru or none, got "random"`,
+		"crawler_interval (-crawler-interval): has to be positive, got 0s",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Fatalf("expected: %q in the error, got: %v", expected, err)
+		}
+	}
+}
+
+func TestShardShareHasToFitTheLargestItem(t *testing.T) {
+	_, err := parse(nil, "-m", "1")
+
+	expected := "memory_limit (-m): every one of the 16 shards gets 65536 bytes, which is less than the item_size_max of 1048576 bytes"
+
+	if err == nil || !strings.Contains(err.Error(), expected) {
+		t.Fatalf("expected: %q in the error, got: %v", expected, err)
+	}
+
+	if _, err := parse(nil, "-m", "1", "-I", "65536"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := parse(nil, "-m", "1", "-shards", "1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMalformedInput(t *testing.T) {
+	if _, err := parse(nil, "-config", writeConfig(t, "prot: 11211\n")); err == nil || !strings.Contains(err.Error(), "field prot not found") {
+		t.Fatalf("expected: an unknown key to be rejected, got: %v", err)
+	}
+
+	if _, err := parse(nil, "-config", writeConfig(t, "crawler_interval: soon\n")); err == nil {
+		t.Fatal("expected: a malformed duration to be rejected")
+	}
+
+	if _, err := parse(map[string]string{"GO_MEMCACHED_PORT": "abc"}); err == nil || !strings.Contains(err.Error(), `GO_MEMCACHED_PORT: invalid integer "abc"`) {
+		t.Fatalf("expected: a malformed environment variable to be named, got: %v", err)
+	}
+
+	if _, err := parse(nil, "-config", filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Fatal("expected: a missing config file to be reported")
+	}
+
+	// an empty file leaves the defaults alone
+	if _, err := parse(nil, "-config", writeConfig(t, "")); err != nil {
+		t.Fatal(err)
+	}
+}
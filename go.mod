@@ -1,3 +1,5 @@
 module github.com/pschlafley/coding-challenges/go-memcache
 
 go 1.21.5
+
+require gopkg.in/yaml.v3 v3.0.1
@@ -1,31 +1,100 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 
+	"github.com/pschlafley/coding-challenges/go-memcache/config"
 	"github.com/pschlafley/coding-challenges/go-memcache/server"
+	"github.com/pschlafley/coding-challenges/go-memcache/types"
 )
 
 func main() {
-	var portFlag string
+	cfg, err := config.Parse(flag.CommandLine, os.Args[1:], os.LookupEnv)
 
-	flag.StringVar(&portFlag, "p", "11211", "Enter in the port you want to bind the tcp server to")
-
-	flag.Parse()
+	if err != nil {
+		log.Fatalf("invalid configuration:\n%v", err)
+	}
 
-	if portFlag == "11211" {
+	if cfg.Port == 11211 {
 		fmt.Println("starting on default port")
 	} else {
-		fmt.Println("starting on port" + portFlag)
+		fmt.Println("starting on port " + strconv.Itoa(cfg.Port))
+	}
+
+	srv := server.NewServer(cfg.Address())
+	srv.Store = types.NewStore(cfg.StoreConfig())
+
+	srv.MaxConns = cfg.MaxConns
+	srv.LogPath = cfg.LogPath
+	srv.SetVerbosity(cfg.LogLevel)
+	srv.SnapshotPath = cfg.SnapshotFile
+	srv.SnapshotOnShutdown = cfg.SnapshotOnShutdown
+
+	if cfg.Restore {
+		restored, skipped, err := srv.Restore()
+
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("restored %d items from %s\n", restored, cfg.SnapshotFile)
+
+		if skipped > 0 {
+			fmt.Printf("skipped %d items of %s that don't fit into the memory limit\n", skipped, cfg.SnapshotFile)
+		}
+	}
+
+	if cfg.OpLog != "" {
+		replayed, skipped, err := srv.OpenOpLog(cfg.OpLog, cfg.OpLogFsync)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("replayed %d operations from %s\n", replayed, cfg.OpLog)
+
+		if skipped > 0 {
+			fmt.Printf("skipped %d items of %s that don't fit into the memory limit\n", skipped, cfg.OpLog)
+		}
 	}
 
-	address := "127.0.0.1:" + portFlag
+	srv.EnableReplication(cfg.ReplBacklog)
 
-	server := server.NewServer(address)
+	if cfg.ReplicaOf != "" {
+		fmt.Println("replicating from " + cfg.ReplicaOf)
+		srv.ReplicaOf(cfg.ReplicaOf)
+	}
+
+	srv.HandleServerMessageQueue()
+	srv.RunCrawler(cfg.CrawlerInterval)
 
-	go server.HandleServerMessageQueue()
+	if cfg.SnapshotInterval > 0 {
+		srv.RunSnapshots(cfg.SnapshotInterval)
+	}
 
-	log.Fatal(server.Start())
+	go func() {
+		if err := srv.Start(); !errors.Is(err, server.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	fmt.Printf("received %s, shutting down\n", <-signals)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,649 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/pschlafley/coding-challenges/go-memcache/types"
+)
+
+const (
+	binaryRequestMagic  = 0x80
+	binaryResponseMagic = 0x81
+	binaryHeaderLen     = 24
+)
+
+// binary protocol opcodes
+const (
+	opGet       = 0x00
+	opSet       = 0x01
+	opAdd       = 0x02
+	opReplace   = 0x03
+	opDelete    = 0x04
+	opIncrement = 0x05
+	opDecrement = 0x06
+	opQuit      = 0x07
+	opFlush     = 0x08
+	opGetQ      = 0x09
+	opNoop      = 0x0a
+	opVersion   = 0x0b
+	opGetK      = 0x0c
+	opGetKQ     = 0x0d
+	opAppend    = 0x0e
+	opPrepend   = 0x0f
+	opStat      = 0x10
+	opSetQ      = 0x11
+	opAddQ      = 0x12
+	opReplaceQ  = 0x13
+	opDeleteQ   = 0x14
+	opIncrQ     = 0x15
+	opDecrQ     = 0x16
+	opQuitQ     = 0x17
+	opFlushQ    = 0x18
+	opAppendQ   = 0x19
+	opPrependQ  = 0x1a
+	opTouch     = 0x1c
+	opGat       = 0x1d
+	opGatQ      = 0x1e
+	opGatK      = 0x23
+	opGatKQ     = 0x24
+)
+
+// binary protocol response statuses
+const (
+	statusOK             = 0x0000
+	statusKeyNotFound    = 0x0001
+	statusKeyExists      = 0x0002
+	statusTooLarge       = 0x0003
+	statusInvalidArgs    = 0x0004
+	statusNotStored      = 0x0005
+	statusNonNumeric     = 0x0006
+	statusUnknownCommand = 0x0081
+	statusOutOfMemory    = 0x0082
+	statusNotSupported   = 0x0083
+	statusInternalError  = 0x0084
+)
+
+// statusMessages is the body sent along with an error status
+var statusMessages = map[uint16]string{
+	statusKeyNotFound:    "Not found",
+	statusKeyExists:      "Data exists for key.",
+	statusTooLarge:       "Too large.",
+	statusInvalidArgs:    "Invalid arguments",
+	statusNotStored:      "Not stored.",
+	statusNonNumeric:     "Non-numeric server-side value for incr or decr",
+	statusUnknownCommand: "Unknown command",
+	statusOutOfMemory:    "Out of memory",
+	statusNotSupported:   "Not supported",
+	statusInternalError:  "Internal error",
+}
+
+// quietOpcodes maps the quiet variant of a command onto the regular one, quiet commands only answer on
+// errors (and for the get variants on hits)
+var quietOpcodes = map[uint8]uint8{
+	opGetQ:     opGet,
+	opGetKQ:    opGetK,
+	opSetQ:     opSet,
+	opAddQ:     opAdd,
+	opReplaceQ: opReplace,
+	opDeleteQ:  opDelete,
+	opIncrQ:    opIncrement,
+	opDecrQ:    opDecrement,
+	opQuitQ:    opQuit,
+	opFlushQ:   opFlush,
+	opAppendQ:  opAppend,
+	opPrependQ: opPrepend,
+	opGatQ:     opGat,
+	opGatKQ:    opGatK,
+}
+
+// binaryHeader is the 24 byte header in front of every binary protocol packet, Status holds the
+// vbucket id in requests
+type binaryHeader struct {
+	Magic     uint8
+	Opcode    uint8
+	KeyLen    uint16
+	ExtrasLen uint8
+	DataType  uint8
+	Status    uint16
+	BodyLen   uint32
+	Opaque    uint32
+	Cas       uint64
+}
+
+type binaryRequest struct {
+	header binaryHeader
+	extras []byte
+	key    []byte
+	value  []byte
+	// command is the opcode with the quiet variants mapped onto the regular command
+	command uint8
+	quiet   bool
+}
+
+// binaryResponse is what a binary command answers with
+type binaryResponse struct {
+	status uint16
+	cas    uint64
+	extras []byte
+	key    []byte
+	value  []byte
+}
+
+// errBinaryTooLarge is returned with the header of a request whose value is larger than the item size
+// limit, its body is still on the connection
+var errBinaryTooLarge = errors.New("value too large")
+
+// readBinaryRequest reads the next binary request off of the connection. The body of a request whose value
+// is larger than maxValue isn't read, the request is returned with just its header along with
+// errBinaryTooLarge so the body can be skipped. maxValue is only called once the header has arrived, so
+// the limit of the current store applies
+func readBinaryRequest(reader *bufio.Reader, maxValue func() int64) (*binaryRequest, error) {
+	req := &binaryRequest{}
+
+	if err := binary.Read(reader, binary.BigEndian, &req.header); err != nil {
+		return nil, err
+	}
+
+	if req.header.Magic != binaryRequestMagic {
+		return nil, fmt.Errorf("invalid magic byte 0x%x", req.header.Magic)
+	}
+
+	keyLen := int(req.header.KeyLen)
+	extrasLen := int(req.header.ExtrasLen)
+	bodyLen := int(req.header.BodyLen)
+
+	if keyLen+extrasLen > bodyLen {
+		return nil, fmt.Errorf("key and extras do not fit into the body")
+	}
+
+	if int64(bodyLen-keyLen-extrasLen) > maxValue() {
+		return req, errBinaryTooLarge
+	}
+
+	body := make([]byte, bodyLen)
+
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+
+	req.extras = body[:extrasLen]
+	req.key = body[extrasLen : extrasLen+keyLen]
+	req.value = body[extrasLen+keyLen:]
+
+	req.command = req.header.Opcode
+
+	if opcode, ok := quietOpcodes[req.header.Opcode]; ok {
+		req.command = opcode
+		req.quiet = true
+	}
+
+	return req, nil
+}
+
+// encodeBinaryResponse builds the response packet for the request, the opcode of the quiet variant the
+// client sent is echoed back
+func encodeBinaryResponse(opcode uint8, opaque uint32, res *binaryResponse) []byte {
+	if res.status != statusOK && res.value == nil {
+		res.value = []byte(statusMessages[res.status])
+	}
+
+	header := binaryHeader{
+		Magic:     binaryResponseMagic,
+		Opcode:    opcode,
+		KeyLen:    uint16(len(res.key)),
+		ExtrasLen: uint8(len(res.extras)),
+		Status:    res.status,
+		BodyLen:   uint32(len(res.extras) + len(res.key) + len(res.value)),
+		Opaque:    opaque,
+		Cas:       res.cas,
+	}
+
+	var buf bytes.Buffer
+
+	buf.Grow(binaryHeaderLen + int(header.BodyLen))
+
+	binary.Write(&buf, binary.BigEndian, header)
+	buf.Write(res.extras)
+	buf.Write(res.key)
+	buf.Write(res.value)
+
+	return buf.Bytes()
+}
+
+// readBinaryConnection handles the binary protocol until the connection is closed or the client quits
+func (s *Server) readBinaryConnection(conn net.Conn, reader *bufio.Reader) {
+	for {
+		req, err := readBinaryRequest(reader, s.itemSizeMax)
+
+		// the body is thrown away without being held in memory, so the next request can still be read
+		if err == errBinaryTooLarge {
+			conn.Write(encodeBinaryResponse(req.header.Opcode, req.header.Opaque, &binaryResponse{status: statusTooLarge}))
+
+			if _, err := io.CopyN(io.Discard, reader, int64(req.header.BodyLen)); err != nil {
+				return
+			}
+
+			continue
+		}
+
+		if err != nil {
+			return
+		}
+
+		if !s.startCommand(conn) {
+			return
+		}
+
+		keepOpen := s.executeBinaryCommand(req, conn)
+
+		if !s.finishCommand(conn) || !keepOpen {
+			return
+		}
+	}
+}
+
+// executeBinaryCommand runs the binary command and writes the response, it returns false when the
+// connection should be closed
+func (s *Server) executeBinaryCommand(req *binaryRequest, conn net.Conn) (keepOpen bool) {
+	keepOpen = true
+	opcode := req.header.Opcode
+
+	out := &responseBuffer{Conn: conn}
+	conn = out
+
+	defer out.flush()
+
+	defer s.lockBinaryCommand(req)()
+
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("error handling binary command 0x%x from %s: %v\n", opcode, conn.RemoteAddr(), r)
+			conn.Write(encodeBinaryResponse(opcode, req.header.Opaque, &binaryResponse{status: statusInternalError}))
+		}
+	}()
+
+	if s.logging() {
+		s.sendMessage(conn, types.ServerCmd{Command: fmt.Sprintf("binary 0x%02x %s", opcode, req.key)}, fmt.Sprintf("binary 0x%02x %s\n", opcode, req.key))
+	}
+
+	if req.command == opStat {
+		s.handleBinaryStat(req, conn)
+		return true
+	}
+
+	// a replica only changes its items through its primary
+	if s.rejectsBinaryWrite(req.command) {
+		conn.Write(encodeBinaryResponse(opcode, req.header.Opaque, &binaryResponse{status: statusNotSupported}))
+		return true
+	}
+
+	res, keepOpen := s.binaryCommand(req)
+
+	// quiet commands only answer when something went wrong, the quiet gets also answer on hits
+	quietGet := req.command == opGet || req.command == opGetK || req.command == opGat || req.command == opGatK
+
+	if req.quiet && (res.status == statusOK && !quietGet || res.status == statusKeyNotFound && quietGet) {
+		return keepOpen
+	}
+
+	conn.Write(encodeBinaryResponse(opcode, req.header.Opaque, res))
+
+	return keepOpen
+}
+
+// lockBinaryCommand locks the shards of the store the binary command works on and returns the function
+// that unlocks them
+func (s *Server) lockBinaryCommand(req *binaryRequest) func() {
+	switch req.command {
+	case opNoop, opVersion, opQuit:
+		return func() {}
+	case opStat:
+		return s.Store.LockAll(false)
+	case opFlush:
+		return s.Store.LockAll(true)
+	}
+
+	return s.Store.LockKeys(true, string(req.key))
+}
+
+// binaryCommand runs the binary command against the store
+func (s *Server) binaryCommand(req *binaryRequest) (*binaryResponse, bool) {
+	switch req.command {
+	case opGet, opGetK, opGat, opGatK:
+		return handleBinaryGet(req, s.Store), true
+	case opSet, opAdd, opReplace:
+		return handleBinarySet(req, s.Store), true
+	case opAppend, opPrepend:
+		return handleBinaryAppend(req, s.Store), true
+	case opDelete:
+		return handleBinaryDelete(req, s.Store), true
+	case opIncrement, opDecrement:
+		return handleBinaryIncrDecr(req, s.Store), true
+	case opTouch:
+		return handleBinaryTouch(req, s.Store), true
+	case opFlush:
+		return handleBinaryFlush(req, s.Store), true
+	case opNoop:
+		return &binaryResponse{}, true
+	case opVersion:
+		return &binaryResponse{value: []byte(Version)}, true
+	case opQuit:
+		return &binaryResponse{}, false
+	}
+
+	return &binaryResponse{status: statusUnknownCommand}, true
+}
+
+// handleBinaryStat sends one packet per stat followed by an empty packet that ends the stats
+func (s *Server) handleBinaryStat(req *binaryRequest, conn net.Conn) {
+	stats, ok := s.statsGroup(string(req.key))
+
+	if !ok {
+		conn.Write(encodeBinaryResponse(opStat, req.header.Opaque, &binaryResponse{status: statusKeyNotFound}))
+		return
+	}
+
+	var buf bytes.Buffer
+
+	for _, st := range stats {
+		buf.Write(encodeBinaryResponse(opStat, req.header.Opaque, &binaryResponse{
+			key:   []byte(st.name),
+			value: []byte(fmt.Sprint(st.value)),
+		}))
+	}
+
+	buf.Write(encodeBinaryResponse(opStat, req.header.Opaque, &binaryResponse{}))
+
+	conn.Write(buf.Bytes())
+}
+
+// binaryKey validates the key of the request
+func binaryKey(req *binaryRequest) (string, bool) {
+	return string(req.key), len(req.key) > 0 && len(req.key) <= maxKeyLength
+}
+
+func handleBinaryGet(req *binaryRequest, store types.Storage) *binaryResponse {
+	key, ok := binaryKey(req)
+
+	touch := req.command == opGat || req.command == opGatK
+
+	if !ok || (touch && len(req.extras) != 4) || (!touch && len(req.extras) != 0) {
+		return &binaryResponse{status: statusInvalidArgs}
+	}
+
+	store.Stats().CmdGet.Add(1)
+
+	var item *types.DataArgs
+	var found bool
+
+	if touch {
+		store.Stats().CmdTouch.Add(1)
+		item, found = store.Touch(key, convertExptime(int64(binary.BigEndian.Uint32(req.extras))))
+	} else {
+		item, found = store.Get(key)
+	}
+
+	if !found {
+		store.Stats().GetMisses.Add(1)
+
+		if touch {
+			store.Stats().TouchMisses.Add(1)
+		}
+
+		// the k variants answer a miss with the key in place of the error message, like memcached does
+		if req.command == opGetK || req.command == opGatK {
+			return &binaryResponse{status: statusKeyNotFound, key: req.key, value: []byte{}}
+		}
+
+		return &binaryResponse{status: statusKeyNotFound}
+	}
+
+	store.Stats().GetHits.Add(1)
+
+	if touch {
+		store.Stats().TouchHits.Add(1)
+	}
+
+	res := &binaryResponse{
+		cas:    item.Cas,
+		extras: binary.BigEndian.AppendUint32(nil, uint32(item.Flags)),
+		value:  item.DataBlock,
+	}
+
+	if req.command == opGetK || req.command == opGatK {
+		res.key = req.key
+	}
+
+	return res
+}
+
+// handleBinarySet handles set, add and replace, a cas in the request header has to match the stored item
+func handleBinarySet(req *binaryRequest, store types.Storage) *binaryResponse {
+	key, ok := binaryKey(req)
+
+	if !ok || len(req.extras) != 8 {
+		return &binaryResponse{status: statusInvalidArgs}
+	}
+
+	store.Stats().CmdSet.Add(1)
+
+	// the store copies the value into a chunk of its slab class so the request body can be reused
+	newItem := &types.DataArgs{
+		Key:       key,
+		DataBlock: req.value,
+		Flags:     int(binary.BigEndian.Uint32(req.extras[:4])),
+		Exptime:   convertExptime(int64(binary.BigEndian.Uint32(req.extras[4:]))),
+		ByteCt:    len(req.value),
+	}
+
+	var err error
+
+	switch {
+	case req.command == opAdd:
+		err = store.Add(newItem)
+	case req.header.Cas != 0:
+		// the item has to exist for the cas to match, so this covers replace as well
+		err = store.CAS(newItem, req.header.Cas)
+
+		switch err {
+		case types.ErrNotFound:
+			store.Stats().CasMisses.Add(1)
+		case types.ErrExists:
+			store.Stats().CasBadval.Add(1)
+		default:
+			store.Stats().CasHits.Add(1)
+		}
+	case req.command == opReplace:
+		err = store.Replace(newItem)
+	default:
+		err = store.Set(newItem)
+	}
+
+	switch {
+	case err == types.ErrNotStored && req.command == opAdd, err == types.ErrExists:
+		return &binaryResponse{status: statusKeyExists}
+	case err == types.ErrNotStored, err == types.ErrNotFound:
+		return &binaryResponse{status: statusKeyNotFound}
+	case err != nil:
+		return &binaryResponse{status: writeErrorStatus(err)}
+	}
+
+	return &binaryResponse{cas: newItem.Cas}
+}
+
+func handleBinaryAppend(req *binaryRequest, store types.Storage) *binaryResponse {
+	key, ok := binaryKey(req)
+
+	if !ok || len(req.extras) != 0 {
+		return &binaryResponse{status: statusInvalidArgs}
+	}
+
+	store.Stats().CmdSet.Add(1)
+
+	item, exists := store.Get(key)
+
+	if !exists {
+		return &binaryResponse{status: statusNotStored}
+	}
+
+	if req.header.Cas != 0 && req.header.Cas != item.Cas {
+		return &binaryResponse{status: statusKeyExists}
+	}
+
+	var err error
+
+	if req.command == opAppend {
+		_, err = store.Append(key, req.value)
+	} else {
+		_, err = store.Prepend(key, req.value)
+	}
+
+	if err != nil {
+		return &binaryResponse{status: writeErrorStatus(err)}
+	}
+
+	return &binaryResponse{cas: item.Cas}
+}
+
+// writeErrorStatus is the status of a write the store couldn't take
+func writeErrorStatus(err error) uint16 {
+	if err == types.ErrOutOfMemory {
+		return statusOutOfMemory
+	}
+
+	return statusTooLarge
+}
+
+func handleBinaryDelete(req *binaryRequest, store types.Storage) *binaryResponse {
+	key, ok := binaryKey(req)
+
+	if !ok || len(req.extras) != 0 {
+		return &binaryResponse{status: statusInvalidArgs}
+	}
+
+	item, exists := store.Get(key)
+
+	if !exists {
+		store.Stats().DeleteMiss.Add(1)
+		return &binaryResponse{status: statusKeyNotFound}
+	}
+
+	if req.header.Cas != 0 && req.header.Cas != item.Cas {
+		return &binaryResponse{status: statusKeyExists}
+	}
+
+	store.Stats().DeleteHits.Add(1)
+
+	store.Delete(key)
+
+	return &binaryResponse{}
+}
+
+// handleBinaryIncrDecr handles increment and decrement, a missing item is created with the initial value
+// unless the expiration is 0xffffffff
+func handleBinaryIncrDecr(req *binaryRequest, store types.Storage) *binaryResponse {
+	key, ok := binaryKey(req)
+
+	if !ok || len(req.extras) != 20 {
+		return &binaryResponse{status: statusInvalidArgs}
+	}
+
+	delta := binary.BigEndian.Uint64(req.extras[:8])
+	initial := binary.BigEndian.Uint64(req.extras[8:16])
+	expiration := binary.BigEndian.Uint32(req.extras[16:])
+
+	hits, misses := &store.Stats().IncrHits, &store.Stats().IncrMisses
+	arithmetic := store.Incr
+
+	if req.command == opDecrement {
+		hits, misses = &store.Stats().DecrHits, &store.Stats().DecrMisses
+		arithmetic = store.Decr
+	}
+
+	item, exists := store.Get(key)
+
+	if !exists {
+		misses.Add(1)
+
+		if expiration == 0xffffffff {
+			return &binaryResponse{status: statusKeyNotFound}
+		}
+
+		item = &types.DataArgs{
+			Key:       key,
+			DataBlock: []byte(strconv.FormatUint(initial, 10)),
+			Exptime:   convertExptime(int64(expiration)),
+		}
+		item.ByteCt = len(item.DataBlock)
+
+		if err := store.Set(item); err != nil {
+			return &binaryResponse{status: writeErrorStatus(err)}
+		}
+	} else {
+		if req.header.Cas != 0 && req.header.Cas != item.Cas {
+			return &binaryResponse{status: statusKeyExists}
+		}
+
+		var err error
+
+		item, err = arithmetic(key, delta)
+
+		if err == types.ErrNonNumeric {
+			return &binaryResponse{status: statusNonNumeric}
+		}
+
+		if err != nil {
+			return &binaryResponse{status: statusInternalError}
+		}
+
+		hits.Add(1)
+	}
+
+	value, _ := strconv.ParseUint(string(item.DataBlock), 10, 64)
+
+	return &binaryResponse{cas: item.Cas, value: binary.BigEndian.AppendUint64(nil, value)}
+}
+
+func handleBinaryTouch(req *binaryRequest, store types.Storage) *binaryResponse {
+	key, ok := binaryKey(req)
+
+	if !ok || len(req.extras) != 4 {
+		return &binaryResponse{status: statusInvalidArgs}
+	}
+
+	store.Stats().CmdTouch.Add(1)
+
+	item, exists := store.Touch(key, convertExptime(int64(binary.BigEndian.Uint32(req.extras))))
+
+	if !exists {
+		store.Stats().TouchMisses.Add(1)
+		return &binaryResponse{status: statusKeyNotFound}
+	}
+
+	store.Stats().TouchHits.Add(1)
+
+	return &binaryResponse{cas: item.Cas}
+}
+
+// handleBinaryFlush flushes the store, the optional extras hold the delay of the flush
+func handleBinaryFlush(req *binaryRequest, store types.Storage) *binaryResponse {
+	var delay uint32
+
+	if len(req.extras) == 4 {
+		delay = binary.BigEndian.Uint32(req.extras)
+	} else if len(req.extras) != 0 {
+		return &binaryResponse{status: statusInvalidArgs}
+	}
+
+	store.Stats().CmdFlush.Add(1)
+	store.Flush(int64(delay))
+
+	return &binaryResponse{}
+}
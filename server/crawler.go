@@ -0,0 +1,57 @@
+package server
+
+import (
+	"time"
+
+	"github.com/pschlafley/coding-challenges/go-memcache/types"
+)
+
+// crawlBatchSize is the amount of items the expiry crawler visits before it lets go of the store lock
+const crawlBatchSize = 100
+
+// DefaultCrawlerInterval is the time between two sweeps of the expiry crawler
+const DefaultCrawlerInterval = 60 * time.Second
+
+// RunCrawler removes expired items in the background so that items which are never read again don't
+// take up memory until they are evicted. Every interval it sweeps over the LRUs of all slab classes in
+// small batches, so commands never have to wait for more than a single batch of a single shard. The
+// crawler runs until the server quits, Shutdown waits for a sweep that is still running
+func (s *Server) RunCrawler(interval time.Duration) {
+	s.background.Add(1)
+
+	go func() {
+		defer s.background.Done()
+		s.runCrawler(interval)
+	}()
+}
+
+// runCrawler sweeps the store every interval until the server quits
+func (s *Server) runCrawler(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-ticker.C:
+		}
+
+		crawled, ok := s.Store.(types.CrawledStorage)
+
+		if !ok {
+			continue
+		}
+
+		s.Store.Stats().CrawlerStarts.Add(1)
+
+		for done := false; !done; {
+			var reclaimed int
+
+			// the store only locks the shard it is sweeping for the length of a batch
+			reclaimed, done = crawled.CrawlExpired(crawlBatchSize)
+
+			s.Store.Stats().CrawlerReclaimed.Add(uint64(reclaimed))
+		}
+	}
+}
@@ -0,0 +1,507 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pschlafley/coding-challenges/go-memcache/types"
+)
+
+// metaFlag is a single flag of a meta command, some flags carry a token like T30 or Oabc
+type metaFlag struct {
+	flag  byte
+	token string
+}
+
+// metaRequest is a parsed meta command "<cmd> <key> [datalen] <flag>*"
+type metaRequest struct {
+	name  string
+	key   string
+	flags []metaFlag
+}
+
+func (m *metaRequest) has(flag byte) bool {
+	_, ok := m.token(flag)
+	return ok
+}
+
+func (m *metaRequest) token(flag byte) (string, bool) {
+	for _, f := range m.flags {
+		if f.flag == flag {
+			return f.token, true
+		}
+	}
+
+	return "", false
+}
+
+// numToken returns the token of the flag as a number, def is returned when the flag is not set
+func (m *metaRequest) numToken(flag byte, def int64) (int64, bool) {
+	token, ok := m.token(flag)
+
+	if !ok {
+		return def, true
+	}
+
+	n, err := strconv.ParseInt(token, 10, 64)
+
+	return n, err == nil
+}
+
+// parseMetaCommand parses the key and the flags of a meta command, base64 encoded keys are decoded.
+// skip is the amount of tokens between the key and the flags, ms has its datalen there
+func parseMetaCommand(cmd types.ServerCmd, skip int) (*metaRequest, string) {
+	cmdSlice := strings.Fields(cmd.Command)
+
+	req := &metaRequest{name: cmdSlice[0], key: cmdSlice[1]}
+
+	for _, f := range cmdSlice[2+skip:] {
+		req.flags = append(req.flags, metaFlag{flag: f[0], token: f[1:]})
+	}
+
+	if req.has('b') {
+		key, err := base64.StdEncoding.DecodeString(req.key)
+
+		if err != nil {
+			return nil, "CLIENT_ERROR bad data chunk\r\n"
+		}
+
+		req.key = string(key)
+	}
+
+	if len(req.key) == 0 || len(req.key) > maxKeyLength {
+		return nil, "CLIENT_ERROR bad command line format\r\n"
+	}
+
+	return req, ""
+}
+
+// metaKey returns the key of the meta command line, decoding it when the b flag is set. The key is
+// returned as is when it can't be decoded, parseMetaCommand will reject it then
+func metaKey(cmdSlice []string) string {
+	for _, f := range cmdSlice[2:] {
+		if f != "b" {
+			continue
+		}
+
+		if key, err := base64.StdEncoding.DecodeString(cmdSlice[1]); err == nil {
+			return string(key)
+		}
+	}
+
+	return cmdSlice[1]
+}
+
+// ttlRemaining is the amount of seconds until the item expires, -1 means it never expires
+func ttlRemaining(item *types.DataArgs) int64 {
+	if item.Exptime == 0 {
+		return -1
+	}
+
+	if ttl := item.Exptime - time.Now().Unix(); ttl > 0 {
+		return ttl
+	}
+
+	return 0
+}
+
+// metaReturnFlags builds the flags that are returned with the response in the order they were requested,
+// item is nil when the key was not found and only the opaque and the key are returned then
+func metaReturnFlags(req *metaRequest, item *types.DataArgs) string {
+	var result strings.Builder
+
+	for _, f := range req.flags {
+		switch {
+		case f.flag == 'O':
+			result.WriteString(" O" + f.token)
+		case f.flag == 'k':
+			if req.has('b') {
+				result.WriteString(" k" + base64.StdEncoding.EncodeToString([]byte(req.key)) + " b")
+			} else {
+				result.WriteString(" k" + req.key)
+			}
+		case item == nil:
+			continue
+		case f.flag == 'c':
+			result.WriteString(fmt.Sprintf(" c%d", item.Cas))
+		case f.flag == 'f':
+			result.WriteString(fmt.Sprintf(" f%d", item.Flags))
+		case f.flag == 's':
+			result.WriteString(fmt.Sprintf(" s%d", item.ByteCt))
+		case f.flag == 't':
+			result.WriteString(fmt.Sprintf(" t%d", ttlRemaining(item)))
+		}
+	}
+
+	return result.String()
+}
+
+// metaValueResult returns the item as "VA <size> <flags>" followed by the value when the v flag is set,
+// otherwise as "HD <flags>"
+func metaValueResult(req *metaRequest, item *types.DataArgs, flags string) string {
+	if req.has('v') {
+		return fmt.Sprintf("VA %d%s\r\n%s\r\n", item.ByteCt, flags, item.DataBlock)
+	}
+
+	return fmt.Sprintf("HD%s\r\n", flags)
+}
+
+// handleMetaCommand handles the meta protocol commands mg, ms, md, ma, mn and me
+func handleMetaCommand(cmd types.ServerCmd, store types.Storage) string {
+	name := strings.Fields(cmd.Command)[0]
+
+	if name == "mn" {
+		return "MN\r\n"
+	}
+
+	skip := 0
+
+	if name == "ms" {
+		skip = 1
+	}
+
+	req, errResult := parseMetaCommand(cmd, skip)
+
+	if req == nil {
+		return errResult
+	}
+
+	switch name {
+	case "mg":
+		return handleMetaGet(req, store)
+	case "ms":
+		return handleMetaSet(req, cmd.DataBlock, store)
+	case "md":
+		return handleMetaDelete(req, store)
+	case "ma":
+		return handleMetaArithmetic(req, store)
+	case "me":
+		return handleMetaDebug(req, store)
+	}
+
+	return "ERROR\r\n"
+}
+
+// handleMetaGet handles "mg <key> <flag>*", with the N flag a missing item is created so that the client
+// that gets the W flag back can fill it while every other client sees the Z flag
+func handleMetaGet(req *metaRequest, store types.Storage) string {
+	store.Stats().CmdGet.Add(1)
+
+	item, ok := store.Get(req.key)
+
+	var stateFlags string
+
+	if !ok {
+		store.Stats().GetMisses.Add(1)
+
+		ttl, valid := req.numToken('N', 0)
+
+		if !valid {
+			return "CLIENT_ERROR bad token in command line format\r\n"
+		}
+
+		if !req.has('N') {
+			if req.has('q') {
+				return ""
+			}
+
+			return fmt.Sprintf("EN%s\r\n", metaReturnFlags(req, nil))
+		}
+
+		item = &types.DataArgs{
+			Key:       req.key,
+			DataBlock: []byte{},
+			Exptime:   convertExptime(ttl),
+			WinSent:   true,
+		}
+
+		store.Set(item)
+
+		stateFlags = " W"
+	} else {
+		store.Stats().GetHits.Add(1)
+
+		if ttl, isSet := req.token('T'); isSet {
+			expTime, err := strconv.ParseInt(ttl, 10, 64)
+
+			if err != nil {
+				return "CLIENT_ERROR bad token in command line format\r\n"
+			}
+
+			store.Touch(req.key, convertExptime(expTime))
+
+			store.Stats().CmdTouch.Add(1)
+			store.Stats().TouchHits.Add(1)
+		}
+
+		if item.Stale {
+			stateFlags = " X"
+		}
+
+		if item.Stale && !item.WinSent {
+			store.Update(req.key, func(item *types.DataArgs) {
+				item.WinSent = true
+			})
+
+			stateFlags += " W"
+		} else if item.WinSent {
+			stateFlags += " Z"
+		}
+	}
+
+	return metaValueResult(req, item, metaReturnFlags(req, item)+stateFlags)
+}
+
+// handleMetaSet handles "ms <key> <datalen> <flag>*", the M flag switches between the modes
+// S set, E add, A append, P prepend and R replace
+func handleMetaSet(req *metaRequest, data []byte, store types.Storage) string {
+	store.Stats().CmdSet.Add(1)
+
+	flags, fValid := req.numToken('F', 0)
+	ttl, tValid := req.numToken('T', 0)
+	compareCas, cValid := req.numToken('C', 0)
+
+	if !fValid || !tValid || !cValid || flags < 0 || flags > 1<<32-1 {
+		return "CLIENT_ERROR bad token in command line format\r\n"
+	}
+
+	mode, _ := req.token('M')
+
+	if mode == "" {
+		mode = "S"
+	}
+
+	item, exists := store.Get(req.key)
+
+	newItem := &types.DataArgs{
+		Key:       req.key,
+		DataBlock: data,
+		Flags:     int(flags),
+		Exptime:   convertExptime(ttl),
+		ByteCt:    len(data),
+	}
+
+	result := "HD"
+
+	switch strings.ToUpper(mode) {
+	case "S":
+	case "E":
+		if exists {
+			result = "NS"
+		}
+	case "R":
+		if !exists {
+			result = "NS"
+		}
+	case "A", "P":
+		if !exists {
+			result = "NS"
+			break
+		}
+
+		dataBlock := make([]byte, 0, len(item.DataBlock)+len(data))
+
+		if strings.ToUpper(mode) == "A" {
+			dataBlock = append(append(dataBlock, item.DataBlock...), data...)
+		} else {
+			dataBlock = append(append(dataBlock, data...), item.DataBlock...)
+		}
+
+		newItem.DataBlock = dataBlock
+		newItem.ByteCt = len(dataBlock)
+		newItem.Flags = item.Flags
+		newItem.Exptime = item.Exptime
+	default:
+		return "CLIENT_ERROR invalid mode for ms\r\n"
+	}
+
+	if result == "HD" && req.has('C') {
+		switch {
+		case !exists:
+			store.Stats().CasMisses.Add(1)
+			result = "NF"
+		case uint64(compareCas) == item.Cas:
+			store.Stats().CasHits.Add(1)
+		case req.has('I') && uint64(compareCas) < item.Cas:
+			// the client is holding an older version, the item is stored but marked as stale
+			newItem.Stale = true
+		default:
+			store.Stats().CasBadval.Add(1)
+			result = "EX"
+		}
+	}
+
+	if result != "HD" {
+		return fmt.Sprintf("%s%s\r\n", result, metaReturnFlags(req, nil))
+	}
+
+	if err := store.Set(newItem); err != nil {
+		return fmt.Sprintf("SERVER_ERROR %v\r\n", err)
+	}
+
+	if req.has('q') {
+		return ""
+	}
+
+	return fmt.Sprintf("HD%s\r\n", metaReturnFlags(req, newItem))
+}
+
+// handleMetaDelete handles "md <key> <flag>*", with the I flag the item is marked as stale instead of removed
+func handleMetaDelete(req *metaRequest, store types.Storage) string {
+	compareCas, cValid := req.numToken('C', 0)
+	ttl, tValid := req.numToken('T', 0)
+
+	if !cValid || !tValid {
+		return "CLIENT_ERROR bad token in command line format\r\n"
+	}
+
+	item, ok := store.Get(req.key)
+
+	if !ok {
+		store.Stats().DeleteMiss.Add(1)
+
+		if req.has('q') {
+			return ""
+		}
+
+		return fmt.Sprintf("NF%s\r\n", metaReturnFlags(req, nil))
+	}
+
+	if req.has('C') && uint64(compareCas) != item.Cas {
+		return fmt.Sprintf("EX%s\r\n", metaReturnFlags(req, nil))
+	}
+
+	store.Stats().DeleteHits.Add(1)
+
+	if req.has('I') {
+		item.Stale = true
+		item.WinSent = false
+
+		if req.has('T') {
+			item.Exptime = convertExptime(ttl)
+		}
+
+		store.Set(item)
+	} else {
+		store.Delete(req.key)
+	}
+
+	if req.has('q') {
+		return ""
+	}
+
+	return fmt.Sprintf("HD%s\r\n", metaReturnFlags(req, nil))
+}
+
+// handleMetaArithmetic handles "ma <key> <flag>*", the M flag switches between incrementing (I or +) and
+// decrementing (D or -) by the delta in the D flag. With the N flag a missing item is created with the
+// value in the J flag
+func handleMetaArithmetic(req *metaRequest, store types.Storage) string {
+	delta, dValid := req.numToken('D', 1)
+	initial, jValid := req.numToken('J', 0)
+	ttl, nValid := req.numToken('N', 0)
+	compareCas, cValid := req.numToken('C', 0)
+
+	if !dValid || !jValid || !nValid || !cValid || delta < 0 || initial < 0 {
+		return "CLIENT_ERROR bad token in command line format\r\n"
+	}
+
+	mode, _ := req.token('M')
+	decr := false
+
+	switch strings.ToUpper(mode) {
+	case "", "I", "+":
+	case "D", "-":
+		decr = true
+	default:
+		return "CLIENT_ERROR invalid mode for ma\r\n"
+	}
+
+	expTime, tValid := req.numToken('T', 0)
+
+	if !tValid {
+		return "CLIENT_ERROR bad token in command line format\r\n"
+	}
+
+	hits, misses := &store.Stats().IncrHits, &store.Stats().IncrMisses
+	arithmetic := store.Incr
+
+	if decr {
+		hits, misses = &store.Stats().DecrHits, &store.Stats().DecrMisses
+		arithmetic = store.Decr
+	}
+
+	item, ok := store.Get(req.key)
+
+	if !ok {
+		misses.Add(1)
+
+		if !req.has('N') {
+			if req.has('q') {
+				return ""
+			}
+
+			return fmt.Sprintf("NF%s\r\n", metaReturnFlags(req, nil))
+		}
+
+		item = &types.DataArgs{
+			Key:       req.key,
+			DataBlock: []byte(strconv.FormatInt(initial, 10)),
+			Exptime:   convertExptime(ttl),
+		}
+		item.ByteCt = len(item.DataBlock)
+
+		if err := store.Set(item); err != nil {
+			return fmt.Sprintf("SERVER_ERROR %v\r\n", err)
+		}
+	} else {
+		if req.has('C') && uint64(compareCas) != item.Cas {
+			return fmt.Sprintf("EX%s\r\n", metaReturnFlags(req, nil))
+		}
+
+		var err error
+
+		item, err = arithmetic(req.key, uint64(delta))
+
+		if err == types.ErrNonNumeric {
+			return fmt.Sprintf("CLIENT_ERROR %v\r\n", err)
+		}
+
+		if err != nil {
+			return fmt.Sprintf("SERVER_ERROR %v\r\n", err)
+		}
+
+		hits.Add(1)
+
+		if req.has('T') {
+			store.Touch(req.key, convertExptime(expTime))
+		}
+	}
+
+	if req.has('q') && !req.has('v') {
+		return ""
+	}
+
+	return metaValueResult(req, item, metaReturnFlags(req, item))
+}
+
+// handleMetaDebug handles "me <key>" which returns the internal details of an item
+func handleMetaDebug(req *metaRequest, store types.Storage) string {
+	item, ok := store.Get(req.key)
+
+	if !ok {
+		return "EN\r\n"
+	}
+
+	key := req.key
+
+	if req.has('b') {
+		key = base64.StdEncoding.EncodeToString([]byte(req.key))
+	}
+
+	return fmt.Sprintf("ME %s exp=%d la=%d cas=%d fetch=no cls=%d size=%d\r\n",
+		key, ttlRemaining(item), time.Now().Unix()-item.Time, item.Cas, item.Class(), item.Size())
+}
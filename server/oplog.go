@@ -0,0 +1,577 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pschlafley/coding-challenges/go-memcache/types"
+)
+
+// the fsync policies of the operation log
+const (
+	FsyncAlways   = "always"
+	FsyncEverySec = "everysec"
+	FsyncNever    = "never"
+)
+
+// an operation log file starts with the magic and the version of its format, followed by the records
+const (
+	opLogMagic   = "GMCL"
+	opLogVersion = 3
+)
+
+// opLogMinCompactSize is the size the operation log has to reach before it is compacted, after that it
+// is compacted whenever it has doubled in size since the last compaction
+const opLogMinCompactSize = 1024 * 1024
+
+// the types of the records in the operation log, a put holds the whole item as it is after the mutation
+// so that replaying it doesn't depend on the state it was applied to
+const (
+	recordPut    byte = 1
+	recordDelete byte = 2
+	recordFlush  byte = 3
+)
+
+var errBadOpLog = errors.New("bad operation log")
+
+// opLog is the append-only file every mutation of the store is recorded in. Every record is framed as
+// <payload length uint32> <crc32 of the payload uint32> <payload>, so a record that was cut off by a
+// crash is detected when the log is replayed
+type opLog struct {
+	mu     sync.Mutex
+	path   string
+	policy string
+	file   *os.File
+	writer *bufio.Writer
+	// size is the size of the log file, compactedSize the size it had after the last compaction
+	size          int64
+	compactedSize int64
+	// rewrite collects the records that are appended while the log is compacted, it is nil otherwise
+	rewrite []byte
+}
+
+func putPayload(item *types.DataArgs) []byte {
+	return appendItem([]byte{recordPut}, item)
+}
+
+func deletePayload(key string) []byte {
+	buf := binary.BigEndian.AppendUint16([]byte{recordDelete}, uint16(len(key)))
+	return append(buf, key...)
+}
+
+// flushPayload records the unix time the flush takes effect at, so a delayed flush is replayed with the
+// same point
+func flushPayload(at int64) []byte {
+	return binary.BigEndian.AppendUint64([]byte{recordFlush}, uint64(at))
+}
+
+func appendRecord(buf []byte, payload []byte) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(payload)))
+	buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(payload))
+
+	return append(buf, payload...)
+}
+
+func opLogHeader() []byte {
+	return append([]byte(opLogMagic), 0, opLogVersion)
+}
+
+// applyRecord applies a record of the operation log to the store
+func applyRecord(payload []byte, store types.Storage, now int64) error {
+	if len(payload) == 0 {
+		return errBadOpLog
+	}
+
+	r := bytes.NewReader(payload[1:])
+
+	switch payload[0] {
+	case recordPut:
+		item, err := readItem(r)
+
+		if err != nil {
+			return err
+		}
+
+		// the item has expired since it was logged, but it may still hide an older value of the key
+		if itemExpired(item, now) {
+			store.Delete(item.Key)
+			return nil
+		}
+
+		err = store.Restore(item)
+
+		// an older value of the key must not come back when the item doesn't fit
+		if itemDoesNotFit(err) {
+			store.Delete(item.Key)
+		}
+
+		return err
+	case recordDelete:
+		var keyLen uint16
+
+		if err := binary.Read(r, binary.BigEndian, &keyLen); err != nil {
+			return err
+		}
+
+		key := make([]byte, keyLen)
+
+		if _, err := io.ReadFull(r, key); err != nil {
+			return err
+		}
+
+		store.Delete(string(key))
+
+		return nil
+	case recordFlush:
+		var at int64
+
+		if err := binary.Read(r, binary.BigEndian, &at); err != nil {
+			return err
+		}
+
+		// the records before the flush were all mutations before it, once its point has passed they are
+		// gone, the items of the records after it are compared with its point by their store time
+		if at <= now {
+			store.Flush(0)
+		}
+
+		store.RestoreFlush(at)
+
+		return nil
+	}
+
+	return fmt.Errorf("%w: unknown record type %d", errBadOpLog, payload[0])
+}
+
+// replayOpLog applies every record of the log file to the store and returns the amount of records, the
+// amount of items that were skipped because they don't fit into the store and the size of the log up to
+// the last complete record. A record that was cut off at the end of the log is ignored, anything else
+// that is broken fails the replay
+func replayOpLog(path string, store types.Storage) (int, int, int64, error) {
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	header := opLogHeader()
+
+	if len(data) < len(header) || !bytes.Equal(data[:len(header)], header) {
+		return 0, 0, 0, errBadOpLog
+	}
+
+	unlock := store.LockAll(true)
+	defer unlock()
+
+	now := time.Now().Unix()
+	offset := len(header)
+	records, skipped := 0, 0
+
+	for offset+8 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[offset:]))
+		sum := binary.BigEndian.Uint32(data[offset+4:])
+
+		if offset+8+length > len(data) {
+			break
+		}
+
+		payload := data[offset+8 : offset+8+length]
+
+		if crc32.ChecksumIEEE(payload) != sum {
+			break
+		}
+
+		err := applyRecord(payload, store, now)
+
+		if itemDoesNotFit(err) {
+			skipped++
+			err = nil
+		}
+
+		if err != nil {
+			return records, skipped, int64(offset), fmt.Errorf("%w: record %d: %v", errBadOpLog, records+1, err)
+		}
+
+		offset += 8 + length
+		records++
+	}
+
+	return records, skipped, int64(offset), nil
+}
+
+// openOpLog replays the log at the path into the store and compacts it, so the log starts out with
+// the current state of the store. It returns the amount of records that were replayed and the amount
+// of items that were skipped because they don't fit into the store
+func openOpLog(path string, policy string, store types.Storage) (*opLog, int, int, error) {
+	if policy != FsyncAlways && policy != FsyncEverySec && policy != FsyncNever {
+		return nil, 0, 0, fmt.Errorf("unknown fsync policy %q, use %s, %s or %s", policy, FsyncAlways, FsyncEverySec, FsyncNever)
+	}
+
+	records, skipped, valid, err := replayOpLog(path, store)
+
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, 0, 0, err
+	}
+
+	if fileInfo, statErr := os.Stat(path); statErr == nil && fileInfo.Size() > valid {
+		fmt.Printf("operation log %s: ignoring %d bytes of an incomplete record\n", path, fileInfo.Size()-valid)
+	}
+
+	l := &opLog{path: path, policy: policy}
+
+	if err := l.compact(store); err != nil {
+		return nil, 0, 0, err
+	}
+
+	return l, records, skipped, nil
+}
+
+// append writes a record to the log, with the always policy it is on disk once append returns
+func (l *opLog) append(payload []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	record := appendRecord(nil, payload)
+
+	if l.rewrite != nil {
+		l.rewrite = append(l.rewrite, record...)
+	}
+
+	l.size += int64(len(record))
+
+	if _, err := l.writer.Write(record); err != nil {
+		fmt.Println("operation log error: ", err)
+		return
+	}
+
+	switch l.policy {
+	case FsyncAlways:
+		l.syncLocked()
+	case FsyncNever:
+		// the data is handed to the operating system which decides when it is written to disk
+		if err := l.writer.Flush(); err != nil {
+			fmt.Println("operation log error: ", err)
+		}
+	}
+}
+
+// sync writes the buffered records to the log file and syncs it to disk
+func (l *opLog) sync() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.syncLocked()
+}
+
+func (l *opLog) syncLocked() {
+	if err := l.writer.Flush(); err != nil {
+		fmt.Println("operation log error: ", err)
+		return
+	}
+
+	if err := l.file.Sync(); err != nil {
+		fmt.Println("operation log error: ", err)
+	}
+}
+
+func (l *opLog) needsCompaction() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.size >= opLogMinCompactSize && l.size >= 2*l.compactedSize
+}
+
+// compact rewrites the log from the current state of the store. The store is only locked while its
+// items are copied, the records that are appended while the new log is written are collected and
+// added to it before it replaces the old one
+func (l *opLog) compact(store types.Storage) error {
+	buf := opLogHeader()
+	now := time.Now().Unix()
+
+	// the store is locked before the log, in the same order as the mutations that append to it
+	unlock := store.LockAll(false)
+
+	if at := pendingFlush(store, now); at != 0 {
+		buf = appendRecord(buf, flushPayload(at))
+	}
+
+	flushAt := store.FlushPoint()
+
+	store.Range(func(item *types.DataArgs) bool {
+		if !itemExpired(item, now) && !itemFlushed(item, flushAt, now) {
+			buf = appendRecord(buf, putPayload(item))
+		}
+
+		return true
+	})
+
+	l.mu.Lock()
+	l.rewrite = []byte{}
+	l.mu.Unlock()
+
+	unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), filepath.Base(l.path)+".tmp*")
+
+	if err == nil {
+		_, err = tmp.Write(buf)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rewrite := l.rewrite
+	l.rewrite = nil
+
+	if err == nil {
+		_, err = tmp.Write(rewrite)
+	}
+
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), l.path)
+	}
+
+	if err != nil {
+		if tmp != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+
+		return err
+	}
+
+	if l.file != nil {
+		l.file.Close()
+	}
+
+	// the temporary file is positioned at its end, so it is appended to from now on
+	l.file = tmp
+	l.writer = bufio.NewWriter(tmp)
+	l.size = int64(len(buf) + len(rewrite))
+	l.compactedSize = l.size
+
+	return nil
+}
+
+// close writes the buffered records to disk and closes the log file
+func (l *opLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.syncLocked()
+
+	return l.file.Close()
+}
+
+// recordSink receives the records of the mutations of a loggedStorage, the operation log and the
+// replication backlog are sinks
+type recordSink interface {
+	append(payload []byte)
+}
+
+// loggedStorage records every mutation of the storage it wraps in its sinks. The methods are called
+// while the keys are locked, so the records of a key are appended in the order of its mutations.
+// Evictions are not recorded, an evicted item comes back when the log is replayed
+type loggedStorage struct {
+	types.Storage
+	sinks []recordSink
+}
+
+// addRecordSink sends the records of the mutations of the store to the sink, the store is wrapped in a
+// loggedStorage when the first sink is added. It has to be called before the server handles commands
+func (s *Server) addRecordSink(sink recordSink) {
+	if ls, ok := s.Store.(*loggedStorage); ok {
+		ls.sinks = append(ls.sinks, sink)
+		return
+	}
+
+	s.Store = &loggedStorage{Storage: s.Store, sinks: []recordSink{sink}}
+}
+
+func (ls *loggedStorage) record(payload []byte) {
+	for _, sink := range ls.sinks {
+		sink.append(payload)
+	}
+}
+
+// logKey records the state the key is in after a mutation
+func (ls *loggedStorage) logKey(key string) {
+	if item, ok := ls.Storage.Get(key); ok {
+		ls.record(putPayload(item))
+	} else {
+		ls.record(deletePayload(key))
+	}
+}
+
+// logResult records the key unless the error says that the mutation didn't change anything, without
+// evictions an item that is out of memory keeps its old value
+func (ls *loggedStorage) logResult(key string, err error) error {
+	switch err {
+	case types.ErrNotStored, types.ErrNotFound, types.ErrExists, types.ErrNonNumeric, types.ErrOutOfMemory:
+		return err
+	}
+
+	ls.logKey(key)
+
+	return err
+}
+
+func (ls *loggedStorage) Set(item *types.DataArgs) error {
+	return ls.logResult(item.Key, ls.Storage.Set(item))
+}
+
+func (ls *loggedStorage) Restore(item *types.DataArgs) error {
+	return ls.logResult(item.Key, ls.Storage.Restore(item))
+}
+
+func (ls *loggedStorage) Add(item *types.DataArgs) error {
+	return ls.logResult(item.Key, ls.Storage.Add(item))
+}
+
+func (ls *loggedStorage) Replace(item *types.DataArgs) error {
+	return ls.logResult(item.Key, ls.Storage.Replace(item))
+}
+
+func (ls *loggedStorage) Append(key string, data []byte) (*types.DataArgs, error) {
+	item, err := ls.Storage.Append(key, data)
+	return item, ls.logResult(key, err)
+}
+
+func (ls *loggedStorage) Prepend(key string, data []byte) (*types.DataArgs, error) {
+	item, err := ls.Storage.Prepend(key, data)
+	return item, ls.logResult(key, err)
+}
+
+func (ls *loggedStorage) Delete(key string) bool {
+	ok := ls.Storage.Delete(key)
+
+	if ok {
+		ls.record(deletePayload(key))
+	}
+
+	return ok
+}
+
+func (ls *loggedStorage) Touch(key string, exptime int64) (*types.DataArgs, bool) {
+	item, ok := ls.Storage.Touch(key, exptime)
+
+	if ok {
+		ls.record(putPayload(item))
+	}
+
+	return item, ok
+}
+
+func (ls *loggedStorage) Update(key string, fn func(item *types.DataArgs)) (*types.DataArgs, bool) {
+	item, ok := ls.Storage.Update(key, fn)
+
+	if ok {
+		ls.record(putPayload(item))
+	}
+
+	return item, ok
+}
+
+func (ls *loggedStorage) Incr(key string, delta uint64) (*types.DataArgs, error) {
+	item, err := ls.Storage.Incr(key, delta)
+	return item, ls.logResult(key, err)
+}
+
+func (ls *loggedStorage) Decr(key string, delta uint64) (*types.DataArgs, error) {
+	item, err := ls.Storage.Decr(key, delta)
+	return item, ls.logResult(key, err)
+}
+
+func (ls *loggedStorage) CAS(item *types.DataArgs, cas uint64) error {
+	return ls.logResult(item.Key, ls.Storage.CAS(item, cas))
+}
+
+func (ls *loggedStorage) Flush(delay int64) {
+	ls.Storage.Flush(delay)
+	ls.record(flushPayload(time.Now().Unix() + delay))
+}
+
+func (ls *loggedStorage) RestoreFlush(at int64) {
+	ls.Storage.RestoreFlush(at)
+	ls.record(flushPayload(at))
+}
+
+// SlabStats passes the slab classes of the wrapped storage through to the stats
+func (ls *loggedStorage) SlabStats() []types.SlabStats {
+	if slabs, ok := ls.Storage.(types.SlabStorage); ok {
+		return slabs.SlabStats()
+	}
+
+	return nil
+}
+
+// CrawlExpired lets the crawler sweep the wrapped storage, the expired items it removes don't need to
+// be recorded since they are dropped when the log is replayed
+func (ls *loggedStorage) CrawlExpired(batch int) (int, bool) {
+	if crawled, ok := ls.Storage.(types.CrawledStorage); ok {
+		return crawled.CrawlExpired(batch)
+	}
+
+	return 0, true
+}
+
+// OpenOpLog replays the operation log at the path into the store and records every mutation from then
+// on. The log is synced and compacted in the background until the server quits and closed by Shutdown,
+// it returns the amount of records that were replayed and the amount of items that were skipped because
+// they don't fit into the store
+func (s *Server) OpenOpLog(path string, policy string) (int, int, error) {
+	l, records, skipped, err := openOpLog(path, policy, s.Store)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	s.opLog = l
+	s.addRecordSink(l)
+
+	s.background.Add(1)
+
+	go func() {
+		defer s.background.Done()
+		s.runOpLog(l)
+	}()
+
+	return records, skipped, nil
+}
+
+// runOpLog syncs the operation log every second with the everysec policy and compacts it once it has grown
+func (s *Server) runOpLog(l *opLog) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-ticker.C:
+		}
+
+		if l.policy == FsyncEverySec {
+			l.sync()
+		}
+
+		if l.needsCompaction() {
+			if err := l.compact(s.Store); err != nil {
+				fmt.Println("operation log compaction error: ", err)
+			}
+		}
+	}
+}
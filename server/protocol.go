@@ -0,0 +1,168 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pschlafley/coding-challenges/go-memcache/types"
+)
+
+// maxLineLength is the maximum length of a command line, it leaves room for multi-gets of a couple of hundred keys
+const maxLineLength = 64 * 1024
+
+var (
+	errBadDataChunk   = errors.New("bad data chunk")
+	errBadCommandLine = errors.New("bad command line format")
+	errLineTooLong    = errors.New("line too long")
+	errValueTooLarge  = errors.New("object too large for cache")
+)
+
+// minTokens is the minimum amount of tokens, including the command itself, a command line needs
+var minTokens = map[string]int{
+	"get":       2,
+	"gets":      2,
+	"gat":       3,
+	"gats":      3,
+	"set":       5,
+	"add":       5,
+	"replace":   5,
+	"append":    5,
+	"prepend":   5,
+	"cas":       6,
+	"delete":    2,
+	"incr":      3,
+	"decr":      3,
+	"touch":     3,
+	"flush_all": 1,
+	"stats":     1,
+	"version":   1,
+	"verbosity": 2,
+	"quit":      1,
+	"snapshot":  1,
+	"mg":        2,
+	"ms":        3,
+	"md":        2,
+	"ma":        2,
+	"mn":        1,
+	"me":        2,
+}
+
+// storageCommands are the commands whose command line is followed by a data block,
+// the value holds the index of the <bytes> field in the command line
+var storageCommands = map[string]int{
+	"set":     4,
+	"add":     4,
+	"replace": 4,
+	"append":  4,
+	"prepend": 4,
+	"cas":     4,
+	"ms":      2,
+}
+
+// readLine reads a single \r\n terminated line from the reader and returns it without the terminator,
+// lines longer than maxLineLength are thrown away
+func readLine(reader *bufio.Reader) (string, error) {
+	var line []byte
+	tooLong := false
+
+	for {
+		chunk, err := reader.ReadSlice('\n')
+
+		if !tooLong && len(line)+len(chunk) > maxLineLength {
+			tooLong = true
+			line = nil
+		}
+
+		if !tooLong {
+			line = append(line, chunk...)
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		if tooLong {
+			return "", errLineTooLong
+		}
+
+		return strings.TrimRight(string(line), "\r\n"), nil
+	}
+}
+
+// readCommand reads the next command off of the connection, for storage commands it also reads
+// exactly the amount of bytes announced in the command line plus the trailing \r\n. A data block larger
+// than maxValue is read and thrown away without being held in memory, so the next command can still be parsed.
+// maxValue is only called once the command line has arrived, so the limit of the current store applies
+func readCommand(reader *bufio.Reader, maxValue func() int64) (*types.ServerCmd, error) {
+	line, err := readLine(reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := &types.ServerCmd{Command: line}
+
+	fields := strings.Fields(line)
+
+	if len(fields) == 0 {
+		return cmd, nil
+	}
+
+	byteCtIdx, ok := storageCommands[fields[0]]
+
+	if !ok {
+		return cmd, nil
+	}
+
+	if len(fields) <= byteCtIdx {
+		return nil, errBadCommandLine
+	}
+
+	byteCt, bCtErr := strconv.Atoi(fields[byteCtIdx])
+
+	if bCtErr != nil || byteCt < 0 {
+		return nil, errBadCommandLine
+	}
+
+	if int64(byteCt) > maxValue() {
+		if _, err := io.CopyN(io.Discard, reader, int64(byteCt)); err != nil {
+			return nil, err
+		}
+
+		if _, err := readLine(reader); err != nil {
+			return nil, err
+		}
+
+		return nil, errValueTooLarge
+	}
+
+	data := make([]byte, byteCt+2)
+
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasSuffix(data, []byte("\r\n")) {
+		// the client sent more data than it announced, throw away the rest of the line so the
+		// next command can still be parsed
+		if data[len(data)-1] != '\n' {
+			if _, err := reader.ReadString('\n'); err != nil {
+				return nil, err
+			}
+		}
+
+		return nil, errBadDataChunk
+	}
+
+	cmd.DataBlock = data[:byteCt]
+
+	return cmd, nil
+}
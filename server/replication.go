@@ -0,0 +1,709 @@
+package server
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pschlafley/coding-challenges/go-memcache/types"
+)
+
+// DefaultReplBacklogSize is the size of the replication backlog when none is given with -repl-backlog
+const DefaultReplBacklogSize = 1024 * 1024
+
+const (
+	// replPingInterval is how often the primary tells a replica its offset and the replica acknowledges
+	// the offset it has applied
+	replPingInterval = time.Second
+	// replRetryInterval is the time a replica waits before it reconnects to its primary
+	replRetryInterval = time.Second
+	// replDialTimeout is how long a replica waits for the connection to its primary
+	replDialTimeout = 5 * time.Second
+)
+
+// recordPing is streamed to the replicas next to the records of the backlog, it carries
+// <offset uint64> <unix time int64> of the primary and doesn't count towards the offset
+const recordPing byte = 4
+
+var (
+	errBacklogGone   = errors.New("the offset is not in the replication backlog")
+	errBadReplStream = errors.New("bad replication stream")
+)
+
+// writeCommands are the text commands a replica rejects, its items only change through its primary
+var writeCommands = map[string]bool{
+	"set":       true,
+	"add":       true,
+	"replace":   true,
+	"append":    true,
+	"prepend":   true,
+	"cas":       true,
+	"delete":    true,
+	"incr":      true,
+	"decr":      true,
+	"touch":     true,
+	"gat":       true,
+	"gats":      true,
+	"flush_all": true,
+	"ms":        true,
+	"md":        true,
+	"ma":        true,
+}
+
+// binaryWriteCommands are the binary commands a replica rejects
+var binaryWriteCommands = map[uint8]bool{
+	opSet:       true,
+	opAdd:       true,
+	opReplace:   true,
+	opDelete:    true,
+	opIncrement: true,
+	opDecrement: true,
+	opFlush:     true,
+	opAppend:    true,
+	opPrepend:   true,
+	opTouch:     true,
+	opGat:       true,
+	opGatK:      true,
+}
+
+// replBacklog keeps the latest records of the mutations in a ring, so a replica that reconnects can
+// resume from its offset instead of syncing the whole store again
+type replBacklog struct {
+	mu sync.Mutex
+	// id names the history of the offsets, a replica can only resume when it synced from the same id
+	id   string
+	data []byte
+	// offset is the amount of bytes that have ever been appended to the backlog
+	offset int64
+	// changed is closed and replaced whenever records are appended
+	changed  chan struct{}
+	replicas map[net.Conn]*replicaLink
+}
+
+// replicaLink is a replica that is connected to the primary
+type replicaLink struct {
+	addr  string
+	acked atomic.Int64
+}
+
+func newReplBacklog(size int) *replBacklog {
+	id := make([]byte, 20)
+	rand.Read(id)
+
+	return &replBacklog{
+		id:       hex.EncodeToString(id),
+		data:     make([]byte, size),
+		changed:  make(chan struct{}),
+		replicas: make(map[net.Conn]*replicaLink),
+	}
+}
+
+func (b *replBacklog) append(payload []byte) {
+	record := appendRecord(nil, payload)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for len(record) > 0 {
+		n := copy(b.data[b.offset%int64(len(b.data)):], record)
+		record = record[n:]
+		b.offset += int64(n)
+	}
+
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// readFrom returns the records from the offset on and a channel that is closed once more records are
+// appended. It fails when the offset has already been overwritten
+func (b *replBacklog) readFrom(offset int64) ([]byte, chan struct{}, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	size := int64(len(b.data))
+
+	if offset < 0 || offset > b.offset || offset < b.offset-size {
+		return nil, nil, errBacklogGone
+	}
+
+	out := make([]byte, b.offset-offset)
+
+	for i := 0; i < len(out); {
+		i += copy(out[i:], b.data[(offset+int64(i))%size:])
+	}
+
+	return out, b.changed, nil
+}
+
+func (b *replBacklog) currentOffset() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.offset
+}
+
+func (b *replBacklog) addReplica(conn net.Conn, offset int64) *replicaLink {
+	link := &replicaLink{addr: conn.RemoteAddr().String()}
+	link.acked.Store(offset)
+
+	b.mu.Lock()
+	b.replicas[conn] = link
+	b.mu.Unlock()
+
+	return link
+}
+
+func (b *replBacklog) removeReplica(conn net.Conn) {
+	b.mu.Lock()
+	delete(b.replicas, conn)
+	b.mu.Unlock()
+}
+
+// EnableReplication keeps a backlog of the mutations of the store that replicas sync from. It has to be
+// called before the server handles commands
+func (s *Server) EnableReplication(backlogSize int) {
+	s.backlog = newReplBacklog(backlogSize)
+	s.addRecordSink(s.backlog)
+}
+
+// serveReplica handles "replicate <id> <offset>". The primary answers with "CONTINUE <offset>" when the
+// replica can resume from its offset, otherwise with "FULLSYNC <id> <offset> <bytes>" followed by a
+// snapshot of the store. After that the records of the mutations are streamed to the replica, which
+// answers with "ack <offset>" lines
+func (s *Server) serveReplica(conn net.Conn, reader *bufio.Reader, cmdSlice []string) {
+	if s.backlog == nil {
+		conn.Write([]byte("SERVER_ERROR replication is not enabled\r\n"))
+		return
+	}
+
+	if len(cmdSlice) != 3 {
+		conn.Write([]byte("CLIENT_ERROR bad command line format\r\n"))
+		return
+	}
+
+	offset, err := strconv.ParseInt(cmdSlice[2], 10, 64)
+
+	if err != nil {
+		conn.Write([]byte("CLIENT_ERROR bad command line format\r\n"))
+		return
+	}
+
+	if _, _, resumeErr := s.backlog.readFrom(offset); cmdSlice[1] != s.backlog.id || resumeErr != nil {
+		offset, err = s.fullSync(conn)
+	} else {
+		_, err = fmt.Fprintf(conn, "CONTINUE %d\r\n", offset)
+	}
+
+	if err != nil {
+		return
+	}
+
+	link := s.backlog.addReplica(conn, offset)
+	defer s.backlog.removeReplica(conn)
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		readAcks(reader, link)
+	}()
+
+	if err := s.streamRecords(conn, offset, done); err != nil {
+		fmt.Printf("replication to %s stopped: %v\n", conn.RemoteAddr(), err)
+	}
+}
+
+// fullSync sends a snapshot of the store and returns the offset of the backlog it was taken at
+func (s *Server) fullSync(conn net.Conn) (int64, error) {
+	// the mutations append to the backlog while their keys are locked, so the offset can't move while
+	// the whole store is locked
+	unlock := s.Store.LockAll(false)
+	data := snapshotItems(s.Store, time.Now().Unix())
+	offset := s.backlog.currentOffset()
+	unlock()
+
+	data = sealSnapshot(data)
+
+	if _, err := fmt.Fprintf(conn, "FULLSYNC %s %d %d\r\n", s.backlog.id, offset, len(data)); err != nil {
+		return 0, err
+	}
+
+	_, err := conn.Write(append(data, "\r\n"...))
+
+	return offset, err
+}
+
+// streamRecords writes the records of the backlog from the offset on to the replica until the
+// connection breaks or the server quits, a ping tells the replica the offset of the primary
+func (s *Server) streamRecords(conn net.Conn, offset int64, done chan struct{}) error {
+	ticker := time.NewTicker(replPingInterval)
+	defer ticker.Stop()
+
+	for {
+		data, changed, err := s.backlog.readFrom(offset)
+
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-ticker.C:
+			if err := sendPing(conn, offset+int64(len(data))); err != nil {
+				return err
+			}
+		default:
+		}
+
+		if len(data) > 0 {
+			if _, err := conn.Write(data); err != nil {
+				return err
+			}
+
+			offset += int64(len(data))
+
+			continue
+		}
+
+		select {
+		case <-changed:
+		case <-ticker.C:
+			if err := sendPing(conn, offset); err != nil {
+				return err
+			}
+		case <-done:
+			return nil
+		case <-s.quit:
+			return nil
+		}
+	}
+}
+
+// sendPing tells the replica the offset of the primary
+func sendPing(conn net.Conn, offset int64) error {
+	ping := binary.BigEndian.AppendUint64([]byte{recordPing}, uint64(offset))
+	ping = binary.BigEndian.AppendUint64(ping, uint64(time.Now().Unix()))
+
+	_, err := conn.Write(appendRecord(nil, ping))
+
+	return err
+}
+
+// readAcks records the offsets the replica acknowledges until the connection is closed
+func readAcks(reader *bufio.Reader, link *replicaLink) {
+	for {
+		line, err := readLine(reader)
+
+		if err != nil {
+			return
+		}
+
+		fields := strings.Fields(line)
+
+		if len(fields) != 2 || fields[0] != "ack" {
+			continue
+		}
+
+		if offset, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+			link.acked.Store(offset)
+		}
+	}
+}
+
+// replicaState is the link of a replica to its primary
+type replicaState struct {
+	primary string
+	mu      sync.Mutex
+	// id is the history of the primary the offset belongs to
+	id string
+	// offset is the offset of the primary the replica has applied, primaryOffset the latest one the
+	// primary has told it about
+	offset        atomic.Int64
+	primaryOffset atomic.Int64
+	// lastIO is the unix time in nanoseconds the replica last heard from the primary
+	lastIO       atomic.Int64
+	connected    atomic.Bool
+	fullSyncs    atomic.Uint64
+	partialSyncs atomic.Uint64
+	// skippedItems is the amount of items of the primary that don't fit into the store of the replica
+	skippedItems atomic.Uint64
+}
+
+func (r *replicaState) position() (string, int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.id, r.offset.Load()
+}
+
+func (r *replicaState) setPosition(id string, offset int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.id = id
+	r.offset.Store(offset)
+	r.primaryOffset.Store(offset)
+}
+
+// ReplicaOf makes the server a read-only replica of the primary at the address, it syncs the store
+// from the primary and applies its mutations until the server quits. It has to be called before the
+// server handles commands
+func (s *Server) ReplicaOf(primary string) {
+	r := &replicaState{primary: primary, id: "?"}
+	r.offset.Store(-1)
+
+	s.replica = r
+
+	s.background.Add(1)
+
+	go func() {
+		defer s.background.Done()
+		s.runReplica(r)
+	}()
+}
+
+// runReplica keeps the replica connected to its primary, it reconnects after the connection breaks
+func (s *Server) runReplica(r *replicaState) {
+	for {
+		if err := s.syncFromPrimary(r); err != nil {
+			fmt.Println("replication error: ", err)
+		}
+
+		r.connected.Store(false)
+
+		select {
+		case <-s.quit:
+			return
+		case <-time.After(replRetryInterval):
+		}
+	}
+}
+
+// syncFromPrimary resumes from the offset of the replica or loads a full sync and then applies the
+// mutations the primary streams until the connection breaks
+func (s *Server) syncFromPrimary(r *replicaState) error {
+	conn, err := net.DialTimeout("tcp", r.primary, replDialTimeout)
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	// closing the connection makes the reads below return once the server quits
+	go func() {
+		select {
+		case <-s.quit:
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	reader := bufio.NewReader(conn)
+	id, offset := r.position()
+
+	if _, err := fmt.Fprintf(conn, "replicate %s %d\r\n", id, offset); err != nil {
+		return err
+	}
+
+	line, err := readLine(reader)
+
+	if err != nil {
+		return err
+	}
+
+	fields := strings.Fields(line)
+
+	switch {
+	case len(fields) == 2 && fields[0] == "CONTINUE":
+		r.partialSyncs.Add(1)
+	case len(fields) == 4 && fields[0] == "FULLSYNC":
+		offset, offsetErr := strconv.ParseInt(fields[2], 10, 64)
+		length, lengthErr := strconv.Atoi(fields[3])
+
+		if offsetErr != nil || lengthErr != nil || length < 0 {
+			return fmt.Errorf("%w: %q", errBadReplStream, line)
+		}
+
+		data := make([]byte, length+2)
+
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return err
+		}
+
+		items, flushAt, err := decodeSnapshot(data[:length])
+
+		if err != nil {
+			return err
+		}
+
+		skipped, err := s.loadFullSync(items, flushAt)
+
+		if err != nil {
+			return err
+		}
+
+		r.skippedItems.Add(uint64(skipped))
+
+		r.setPosition(fields[1], offset)
+		r.fullSyncs.Add(1)
+	default:
+		return fmt.Errorf("%s answered %q", r.primary, line)
+	}
+
+	r.connected.Store(true)
+	r.lastIO.Store(time.Now().UnixNano())
+
+	go sendAcks(conn, r, stop)
+
+	return s.applyStream(reader, r)
+}
+
+// loadFullSync replaces the items and the pending flush of the store with the ones of the primary, it
+// returns the amount of items that were skipped because they don't fit into the store
+func (s *Server) loadFullSync(items []*types.DataArgs, flushAt int64) (int, error) {
+	now := time.Now().Unix()
+
+	unlock := s.Store.LockAll(true)
+	defer unlock()
+
+	s.Store.Flush(0)
+
+	if flushAt != 0 {
+		s.Store.RestoreFlush(flushAt)
+	}
+
+	skipped := 0
+
+	for _, item := range items {
+		if itemExpired(item, now) {
+			continue
+		}
+
+		err := s.Store.Restore(item)
+
+		if itemDoesNotFit(err) {
+			skipped++
+			continue
+		}
+
+		if err != nil {
+			return skipped, err
+		}
+	}
+
+	return skipped, nil
+}
+
+// sendAcks tells the primary the offset the replica has applied until the stop channel is closed
+func sendAcks(conn net.Conn, r *replicaState, stop chan struct{}) {
+	ticker := time.NewTicker(replPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if _, err := fmt.Fprintf(conn, "ack %d\r\n", r.offset.Load()); err != nil {
+			return
+		}
+	}
+}
+
+// applyStream applies the records the primary streams until the connection breaks
+func (s *Server) applyStream(reader *bufio.Reader, r *replicaState) error {
+	header := make([]byte, 8)
+
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return err
+		}
+
+		payload := make([]byte, binary.BigEndian.Uint32(header))
+
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return err
+		}
+
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+			return fmt.Errorf("%w: checksum mismatch", errBadReplStream)
+		}
+
+		r.lastIO.Store(time.Now().UnixNano())
+
+		if len(payload) > 0 && payload[0] == recordPing {
+			if len(payload) != 17 {
+				return fmt.Errorf("%w: bad ping", errBadReplStream)
+			}
+
+			r.primaryOffset.Store(int64(binary.BigEndian.Uint64(payload[1:])))
+
+			continue
+		}
+
+		err := s.applyReplicated(payload)
+
+		if itemDoesNotFit(err) {
+			r.skippedItems.Add(1)
+			err = nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		offset := r.offset.Add(int64(len(header) + len(payload)))
+
+		if offset > r.primaryOffset.Load() {
+			r.primaryOffset.Store(offset)
+		}
+	}
+}
+
+// applyReplicated applies a record of the primary with the keys it changes locked
+func (s *Server) applyReplicated(payload []byte) error {
+	var unlock func()
+
+	if key, ok := recordKey(payload); ok {
+		unlock = s.Store.LockKeys(true, key)
+	} else {
+		unlock = s.Store.LockAll(true)
+	}
+
+	defer unlock()
+
+	return applyRecord(payload, s.Store, time.Now().Unix())
+}
+
+// recordKey returns the key of a put or a delete record
+func recordKey(payload []byte) (string, bool) {
+	if len(payload) < 3 || payload[0] != recordPut && payload[0] != recordDelete {
+		return "", false
+	}
+
+	keyLen := int(binary.BigEndian.Uint16(payload[1:]))
+
+	if len(payload) < 3+keyLen {
+		return "", false
+	}
+
+	return string(payload[3 : 3+keyLen]), true
+}
+
+// rejectsWrite reports whether the server is a replica and the command would change its items, the
+// meta get is only rejected when its flags touch or create the item
+func (s *Server) rejectsWrite(cmdSlice []string) bool {
+	if s.replica == nil || len(cmdSlice) == 0 {
+		return false
+	}
+
+	if cmdSlice[0] == "mg" && len(cmdSlice) > 2 {
+		for _, flag := range cmdSlice[2:] {
+			if strings.HasPrefix(flag, "T") || strings.HasPrefix(flag, "N") {
+				return true
+			}
+		}
+	}
+
+	return writeCommands[cmdSlice[0]]
+}
+
+// rejectsBinaryWrite reports whether the server is a replica and the binary command would change its items
+func (s *Server) rejectsBinaryWrite(command uint8) bool {
+	return s.replica != nil && binaryWriteCommands[command]
+}
+
+// replicationStats reports the link to the primary on a replica and the connected replicas on a
+// server that has replication enabled
+func (s *Server) replicationStats() []stat {
+	var stats []stat
+
+	if r := s.replica; r != nil {
+		id, offset := r.position()
+		primaryOffset := r.primaryOffset.Load()
+
+		status := "down"
+
+		if r.connected.Load() {
+			status = "up"
+		}
+
+		lastIO := int64(-1)
+
+		if t := r.lastIO.Load(); t > 0 {
+			lastIO = int64(time.Since(time.Unix(0, t)).Seconds())
+		}
+
+		stats = append(stats,
+			stat{"role", "replica"},
+			stat{"primary", r.primary},
+			stat{"primary_link_status", status},
+			stat{"primary_last_io_seconds_ago", lastIO},
+			stat{"primary_repl_id", id},
+			stat{"primary_repl_offset", primaryOffset},
+			stat{"replica_repl_offset", offset},
+			stat{"replica_lag_bytes", max(primaryOffset-offset, 0)},
+			stat{"full_syncs", r.fullSyncs.Load()},
+			stat{"partial_syncs", r.partialSyncs.Load()},
+			stat{"skipped_items", r.skippedItems.Load()},
+		)
+	} else {
+		stats = append(stats, stat{"role", "primary"})
+	}
+
+	b := s.backlog
+
+	if b == nil {
+		return stats
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	links := make([]*replicaLink, 0, len(b.replicas))
+
+	for _, link := range b.replicas {
+		links = append(links, link)
+	}
+
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].addr < links[j].addr
+	})
+
+	stats = append(stats,
+		stat{"repl_id", b.id},
+		stat{"repl_offset", b.offset},
+		stat{"repl_backlog_size", len(b.data)},
+		stat{"connected_replicas", len(links)},
+	)
+
+	for i, link := range links {
+		prefix := fmt.Sprintf("replica%d:", i)
+		acked := link.acked.Load()
+
+		stats = append(stats,
+			stat{prefix + "addr", link.addr},
+			stat{prefix + "acked_offset", acked},
+			stat{prefix + "lag_bytes", max(b.offset-acked, 0)},
+		)
+	}
+
+	return stats
+}
@@ -2,6 +2,8 @@ package server
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -9,36 +11,106 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pschlafley/coding-challenges/go-memcache/types"
 )
 
+// maxKeyLength is the maximum length of a key in bytes
+const maxKeyLength = 250
+
+// Version is returned by the version command, it is set at build time with
+// -ldflags "-X github.com/pschlafley/coding-challenges/go-memcache/server.Version=<version>"
+var Version = "0.1.0"
+
+// messageQueueSize is the amount of log messages that can be queued up before the commands have to wait
+// for the log file
+const messageQueueSize = 1024
+
+const (
+	// DefaultMaxBytes is the memory limit of the store when none is given with -m
+	DefaultMaxBytes = 64 * 1024 * 1024
+	// DefaultGrowthFactor is the factor between the chunk sizes of the slab classes when none is given with -f
+	DefaultGrowthFactor = 1.25
+	// DefaultChunkSize is the space for the key and value in the smallest slab class when none is given with -n
+	DefaultChunkSize = 48
+	// DefaultShards is the amount of shards the store is split into when none is given with -shards
+	DefaultShards = 16
+	// DefaultMaxConns is the amount of connections the server serves at once when none is given with -c
+	DefaultMaxConns = 1024
+	// DefaultLogPath is the file the commands are logged to when none is given with -log-path
+	DefaultLogPath = "./logs/server.log"
+)
+
 type Server struct {
 	ListenAddr string
 	Listener   net.Listener
 	quit       chan struct{}
 	MsgCh      chan types.Message
-	PeerMap    map[net.Addr]string
+	PeerMap    map[net.Addr]*types.Peer
+	// peersMu guards the PeerMap, the peers in it and the Listener, the connections add and remove
+	// themselves while stats reads it and Shutdown closes them
+	peersMu    sync.RWMutex
 	mu         sync.Mutex
-	Store      *types.Store
+	Store      types.Storage
+	startTime  time.Time
+	totalConns atomic.Uint64
+	// MaxConns is the amount of connections served at once, further connections are turned away, 0
+	// means no limit
+	MaxConns      int
+	rejectedConns atomic.Uint64
+	// LogPath is the file the log goroutine writes the commands to
+	LogPath string
+	// verbosity is the logging level set with the verbosity command, 0 turns the command log off
+	verbosity atomic.Int32
+	// SnapshotPath is the file the snapshot command writes the items to
+	SnapshotPath string
+	// opLog records the mutations of the store once OpenOpLog has been called, nil otherwise
+	opLog *opLog
+	// backlog holds the mutations for the replicas once EnableReplication has been called, replica is
+	// the link to the primary once ReplicaOf has been called
+	backlog *replBacklog
+	replica *replicaState
+	// SnapshotOnShutdown writes a snapshot once Shutdown has drained the connections
+	SnapshotOnShutdown bool
+	shuttingDown       atomic.Bool
+	// conns are the connections that are being read, background the goroutines Shutdown waits for
+	// after it has closed quit
+	conns      sync.WaitGroup
+	background sync.WaitGroup
+	// logDone is closed once the log goroutine has written out the queue and stopped
+	logDone chan struct{}
 }
 
-func NewServer(address string) *Server {
-	dbMap := make(map[string]*types.DataArgs, 1)
+// ErrServerClosed is returned by Start once the server has been shut down and by every further
+// call of Shutdown
+var ErrServerClosed = errors.New("server closed")
 
-	store := &types.Store{
-		Db:   &dbMap,
-		Size: 1000,
+func NewServer(address string) *Server {
+	store := types.NewStore(types.StoreConfig{
+		MaxBytes:  DefaultMaxBytes,
+		Factor:    DefaultGrowthFactor,
+		ChunkSize: DefaultChunkSize,
+		Shards:    DefaultShards,
+	})
+
+	server := &Server{
+		ListenAddr:   address,
+		quit:         make(chan struct{}),
+		MsgCh:        make(chan types.Message, messageQueueSize),
+		logDone:      make(chan struct{}),
+		PeerMap:      make(map[net.Addr]*types.Peer),
+		Store:        store,
+		startTime:    time.Now(),
+		SnapshotPath: DefaultSnapshotPath,
+		MaxConns:     DefaultMaxConns,
+		LogPath:      DefaultLogPath,
 	}
 
-	return &Server{
-		ListenAddr: address,
-		quit:       make(chan struct{}),
-		MsgCh:      make(chan types.Message),
-		PeerMap:    make(map[net.Addr]string),
-		Store:      store,
-	}
+	server.verbosity.Store(1)
+
+	return server
 }
 
 func OpenLogFile(fileName string) (*os.File, error) {
@@ -60,8 +132,15 @@ func handleRemoveLogs(file *os.File) error {
 	return nil
 }
 
+// HandleServerMessageQueue starts the goroutine that writes the queued messages to the log file, it
+// writes out what is left in the queue and stops once the server quits
 func (s *Server) HandleServerMessageQueue() {
+	s.background.Add(1)
+
 	go func() {
+		defer s.background.Done()
+		defer close(s.logDone)
+
 		// since there could be multiple goroutines reading/writing from the messages queue and to the file
 		// I am using a mutex to lock so that only one goroutine can perform a read/write at a time
 		s.mu.Lock()
@@ -69,33 +148,62 @@ func (s *Server) HandleServerMessageQueue() {
 		defer s.mu.Unlock()
 		messageQueue := types.NewQueue[*types.Message]()
 		for {
-			file, err := OpenLogFile("./logs/server.log")
-
-			if err != nil {
-				log.Fatal(err)
+			select {
+			case msg := <-s.MsgCh:
+				s.writeMessage(messageQueue, msg)
+			case <-s.quit:
+				// the connections have been drained by now, so nothing is added to the queue anymore
+				for {
+					select {
+					case msg := <-s.MsgCh:
+						s.writeMessage(messageQueue, msg)
+					default:
+						return
+					}
+				}
 			}
+		}
+	}()
+}
 
-			msg := <-s.MsgCh
+// writeMessage appends the message to the log file
+func (s *Server) writeMessage(messageQueue *types.Queue[*types.Message], msg types.Message) {
+	// with logging off the log file isn't touched at all
+	if !s.logging() {
+		return
+	}
 
-			messageQueue.Enque(&msg)
+	file, err := OpenLogFile(s.LogPath)
 
-			node := messageQueue.Head()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-			fmtString := fmt.Sprintf("%v %s: %s", node.Value().TimeStamp, node.Value().RemoteAddr, node.Value().Text)
+	defer file.Close()
 
-			_, wErr := file.WriteString(strings.TrimSpace(fmtString))
+	messageQueue.Enque(&msg)
 
-			if wErr != nil {
-				log.Fatal(wErr)
-			}
+	node := messageQueue.Head()
 
-			messageQueue.Deque()
+	fmtString := fmt.Sprintf("%v %s: %s", node.Value().TimeStamp, node.Value().RemoteAddr, node.Value().Text)
 
-			// handleRemoveLogs(file)
+	_, wErr := file.WriteString(strings.TrimSpace(fmtString))
 
-			file.Close()
-		}
-	}()
+	if wErr != nil {
+		log.Fatal(wErr)
+	}
+
+	messageQueue.Deque()
+
+	// handleRemoveLogs(file)
+}
+
+// queueMessage hands the message to the log goroutine, it is dropped once the log goroutine has stopped
+func (s *Server) queueMessage(msg types.Message) {
+	select {
+	case s.MsgCh <- msg:
+	case <-s.logDone:
+	}
 }
 
 func (s *Server) Start() error {
@@ -107,17 +215,18 @@ func (s *Server) Start() error {
 
 	defer ln.Close()
 
+	s.peersMu.Lock()
 	s.Listener = ln
+	s.peersMu.Unlock()
 
 	go s.AcceptConnections()
 
 	// Wait here for the quit channel until that is done, if the quit channel is done then we can defer the ln.Close() func and clean everything up
 	<-s.quit
 
-	// If we are stopping our server other people can still be reading from the MsgCh so we need to notify them that we are closing the channel by closing it
-	close(s.MsgCh)
-
-	return nil
+	// the MsgCh isn't closed, the connections that are still running when Shutdown gives up on them
+	// could be sending to it. The log goroutine stops on the quit channel instead
+	return ErrServerClosed
 }
 
 func (s *Server) AcceptConnections() {
@@ -127,15 +236,49 @@ func (s *Server) AcceptConnections() {
 		conn, err := s.Listener.Accept()
 
 		if err != nil {
+			// the listener is closed when the server shuts down
+			if errors.Is(err, net.ErrClosed) || s.shuttingDown.Load() {
+				return
+			}
+
 			fmt.Println("accept error: ", err)
 			continue
 		}
 
 		fmt.Println("New Connection: ", conn.RemoteAddr())
 
-		peerVal := fmt.Sprintf("conn%d", i)
+		peerVal := &types.Peer{
+			Name:        fmt.Sprintf("conn%d", i),
+			Conn:        conn,
+			ConnectedAt: time.Now(),
+			LastCmdAt:   time.Now(),
+		}
+
+		s.peersMu.Lock()
+
+		// a connection that was accepted while Shutdown closed the listener isn't served anymore
+		if s.shuttingDown.Load() {
+			s.peersMu.Unlock()
+			conn.Close()
+
+			return
+		}
+
+		if s.MaxConns > 0 && len(s.PeerMap) >= s.MaxConns {
+			s.peersMu.Unlock()
+			s.rejectedConns.Add(1)
+
+			conn.Write([]byte("ERROR Too many open connections\r\n"))
+			conn.Close()
+
+			continue
+		}
 
 		s.PeerMap[conn.RemoteAddr()] = peerVal
+		s.conns.Add(1)
+		s.peersMu.Unlock()
+
+		s.totalConns.Add(1)
 
 		i += 1
 
@@ -145,568 +288,830 @@ func (s *Server) AcceptConnections() {
 }
 
 func (s *Server) ReadConnections(conn net.Conn) {
+	defer s.conns.Done()
 	defer conn.Close()
 
-	buf := make([]byte, 2048)
+	reader := bufio.NewReader(conn)
 
-	cmd := &types.ServerCmd{}
+	// binary protocol clients start every request with the magic byte, everybody else speaks the text protocol
+	if magic, err := reader.Peek(1); err == nil && magic[0] == binaryRequestMagic {
+		s.readBinaryConnection(conn, reader)
+	} else {
+		s.readTextConnection(conn, reader)
+	}
 
-	for {
-		n, err := conn.Read(buf)
+	fmt.Printf("connection closed: %s\n", conn.RemoteAddr())
 
-		if err != nil {
-			fmt.Printf("connection closed: %s\n", conn.RemoteAddr())
-			delete(s.PeerMap, conn.RemoteAddr())
-			return
-		}
+	s.peersMu.Lock()
+	delete(s.PeerMap, conn.RemoteAddr())
+	s.peersMu.Unlock()
+}
 
-		data := buf[:n]
+// startCommand records that the client has just sent a command and marks it busy until finishCommand,
+// it returns false when the server is shutting down and the command shouldn't run anymore
+func (s *Server) startCommand(conn net.Conn) bool {
+	s.peersMu.Lock()
+	defer s.peersMu.Unlock()
 
-		s.dataParser(conn, cmd, data)
+	if s.shuttingDown.Load() {
+		return false
 	}
+
+	if peer, ok := s.PeerMap[conn.RemoteAddr()]; ok {
+		peer.LastCmdAt = time.Now()
+		peer.Busy = true
+	}
+
+	return true
 }
 
-func (s *Server) dataParser(conn net.Conn, cmd *types.ServerCmd, data []byte) {
-	dataSlice := strings.Split(string(data), " ")
+// finishCommand marks the client idle again, it returns false when the server is shutting down and the
+// connection should be closed
+func (s *Server) finishCommand(conn net.Conn) bool {
+	s.peersMu.Lock()
+	defer s.peersMu.Unlock()
 
-	switch dataSlice[0] != "" {
-	case dataSlice[0] != "set" && dataSlice[0] != "get" && dataSlice[0] != "add" && dataSlice[0] != "replace" && dataSlice[0] != "append" && dataSlice[0] != "prepend" && dataSlice[0] != "delete" && dataSlice[0] != "increment" && dataSlice[0] != "decrement":
-		cmd.DataBlock = string(data)
-	case dataSlice[0] == "set":
-		cmd.Command = string(data)
-		cmd.DataBlock = ""
-	case dataSlice[0] == "get":
-		cmd.Command = string(data)
-	case dataSlice[0] == "add":
-		cmd.Command = string(data)
-		cmd.DataBlock = ""
-	case dataSlice[0] == "replace":
-		cmd.Command = string(data)
-		cmd.DataBlock = ""
-	case dataSlice[0] == "append":
-		cmd.Command = string(data)
-		cmd.DataBlock = ""
-	case dataSlice[0] == "prepend":
-		cmd.Command = string(data)
-		cmd.DataBlock = ""
-	case dataSlice[0] == "delete":
-		cmd.Command = string(data)
-	case dataSlice[0] == "increment":
-		cmd.Command = string(data)
-		cmd.DataBlock = ""
-	case dataSlice[0] == "decrement":
-		cmd.Command = string(data)
-		cmd.DataBlock = ""
+	if peer, ok := s.PeerMap[conn.RemoteAddr()]; ok {
+		peer.Busy = false
 	}
 
-	s.commandParser(cmd, conn)
+	return !s.shuttingDown.Load()
 }
 
-func (s *Server) commandParser(cmd *types.ServerCmd, conn net.Conn) {
-	parsedCmd := strings.Split(cmd.Command, " ")
+// peerCount is the amount of connected clients
+func (s *Server) peerCount() int {
+	s.peersMu.RLock()
+	defer s.peersMu.RUnlock()
 
-	msgStruct := &types.Message{}
+	return len(s.PeerMap)
+}
 
-	switch parsedCmd[0] != "" {
-	case parsedCmd[0] == "set" && cmd.DataBlock != "":
-		if len((*s.Store.Db)) > s.Store.Size {
-			msgStruct.Cmd = types.ServerCmd{}
-			msgStruct.RemoteAddr = conn.RemoteAddr()
-			msgStruct.Text = "Store is at it's maximum capacity!\n"
-
-			s.MsgCh <- *msgStruct
-			conn.Write([]byte(msgStruct.Text))
-			msgStruct.Cmd.Command = ""
-			msgStruct.Cmd.DataBlock = ""
-
-			var i int = 0
-			for i < 1 {
-				for k := range *s.Store.Db {
-					delete(*s.Store.Db, k)
-					i++
-				}
-			}
+// itemSizeMax is the size of the largest value a request may carry, storage engines that don't set a
+// limit get the largest item size
+func (s *Server) itemSizeMax() int64 {
+	if limit := s.Store.Config().ItemSizeMax; limit > 0 {
+		return limit
+	}
 
-			i = 0
-			break
-		} else {
-			msgStruct.Cmd = types.ServerCmd{
-				Command:   cmd.Command,
-				DataBlock: cmd.DataBlock,
-			}
-			msgStruct.RemoteAddr = conn.RemoteAddr()
+	return types.MaxItemSize
+}
 
-			cmdSlice := strings.Split(msgStruct.Cmd.Command, " ")
+// readTextConnection handles the text protocol until the connection is closed or the client quits
+func (s *Server) readTextConnection(conn net.Conn, reader *bufio.Reader) {
+	// commands can be pipelined and a command line and its data block can arrive in the same or in
+	// separate reads, so the reader takes care of framing each command on the \r\n boundaries
+	for {
+		cmd, err := readCommand(reader, s.itemSizeMax)
 
-			msgStruct.Text = fmt.Sprintf("%s %s %s %s %s\n", cmdSlice[0], cmdSlice[1], cmdSlice[2], cmdSlice[4], msgStruct.Cmd.DataBlock)
-			msgStruct.TimeStamp = time.Now().Format(time.ANSIC)
+		if err == errValueTooLarge {
+			conn.Write([]byte("SERVER_ERROR object too large for cache\r\n"))
+			continue
+		}
 
-			s.MsgCh <- *msgStruct
-			msgStruct.Cmd.Command = ""
-			msgStruct.Cmd.DataBlock = ""
+		if err == errBadDataChunk {
+			conn.Write([]byte("CLIENT_ERROR bad data chunk\r\n"))
+			continue
+		}
 
-			result := handleSetData(*cmd, s.Store)
-			conn.Write([]byte(result))
-			cmd.Command = ""
-			cmd.DataBlock = ""
+		if err == errBadCommandLine {
+			conn.Write([]byte("CLIENT_ERROR bad command line format\r\n"))
+			continue
 		}
 
-	case parsedCmd[0] == "get":
-		result := handleGetData(parsedCmd, s.Store)
+		if err == errLineTooLong {
+			conn.Write([]byte("CLIENT_ERROR line too long\r\n"))
+			continue
+		}
 
-		if strings.TrimSpace(result) != "END" {
-			msgStruct.Cmd = types.ServerCmd{
-				Command:   cmd.Command,
-				DataBlock: cmd.DataBlock,
-			}
+		if err != nil {
+			return
+		}
 
-			msgStruct.RemoteAddr = conn.RemoteAddr()
+		if !s.startCommand(conn) {
+			return
+		}
 
-			cmdSlice := strings.Split(msgStruct.Cmd.Command, " ")
-			resultSlice := strings.Split(strings.TrimSpace(result), "\n")
+		// a replica takes the connection over to sync from this server, it counts as idle so Shutdown
+		// doesn't wait for it
+		if fields := strings.Fields(cmd.Command); len(fields) > 0 && fields[0] == "replicate" {
+			s.finishCommand(conn)
+			s.serveReplica(conn, reader, fields)
 
-			msgStruct.Text = fmt.Sprintf("%s: %s %s\r", cmdSlice[0], resultSlice[0], resultSlice[1])
-			msgStruct.TimeStamp = time.Now().Format(time.ANSIC)
+			return
+		}
 
-			s.MsgCh <- *msgStruct
-			msgStruct.Cmd.Command = ""
-			msgStruct.Cmd.DataBlock = ""
+		keepOpen := s.executeCommand(cmd, conn)
 
-		} else {
-			msgStruct.Cmd = types.ServerCmd{
-				Command:   cmd.Command,
-				DataBlock: cmd.DataBlock,
-			}
+		if !s.finishCommand(conn) || !keepOpen {
+			return
+		}
+	}
+}
+
+// executeCommand runs the command and answers with SERVER_ERROR if handling it fails unexpectedly, so that
+// a single bad command does not take down the whole server. It returns false when the connection should be closed
+func (s *Server) executeCommand(cmd *types.ServerCmd, conn net.Conn) (keepOpen bool) {
+	keepOpen = true
+	res := &responseBuffer{Conn: conn}
 
-			msgStruct.RemoteAddr = conn.RemoteAddr()
+	// the deferred calls run backwards, so the response is written after the store has been unlocked
+	defer res.flush()
 
-			cmdSlice := strings.Split(msgStruct.Cmd.Command, " ")
+	cmdSlice := strings.Fields(cmd.Command)
 
-			msgStruct.Text = fmt.Sprintf("%s: Failed! Key not found!\n", cmdSlice[0])
-			msgStruct.TimeStamp = time.Now().Format(time.ANSIC)
+	if s.rejectsWrite(cmdSlice) {
+		res.Write([]byte("SERVER_ERROR replica is read-only\r\n"))
+		return true
+	}
+
+	defer s.lockCommand(cmdSlice)()
 
-			s.MsgCh <- *msgStruct
-			msgStruct.Cmd.Command = ""
-			msgStruct.Cmd.DataBlock = ""
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("error handling command %q from %s: %v\n", cmd.Command, conn.RemoteAddr(), r)
+			res.Write([]byte(fmt.Sprintf("SERVER_ERROR %v\r\n", r)))
 		}
+	}()
 
-		conn.Write([]byte(result))
+	return s.commandParser(cmd, res)
+}
 
-	case parsedCmd[0] == "add" && cmd.DataBlock != "":
-		if len((*s.Store.Db)) > s.Store.Size {
-			msgStruct.Cmd = types.ServerCmd{}
-			msgStruct.RemoteAddr = conn.RemoteAddr()
-			msgStruct.Text = "Store is at it's maximum capacity!"
+// lockCommand locks the shards of the store that hold the keys of the command and returns the function
+// that unlocks them, stats and flush_all lock the whole store
+func (s *Server) lockCommand(cmdSlice []string) func() {
+	if len(cmdSlice) == 0 || len(cmdSlice) < minTokens[cmdSlice[0]] {
+		return func() {}
+	}
 
-			s.MsgCh <- *msgStruct
-			conn.Write([]byte(msgStruct.Text))
+	switch cmdSlice[0] {
+	case "get", "gets":
+		return s.Store.LockKeys(true, cmdSlice[1:]...)
+	case "gat", "gats":
+		return s.Store.LockKeys(true, cmdSlice[2:]...)
+	case "set", "add", "replace", "append", "prepend", "cas", "delete", "incr", "decr", "touch":
+		return s.Store.LockKeys(true, cmdSlice[1])
+	case "mg", "ms", "md", "ma", "me":
+		return s.Store.LockKeys(true, metaKey(cmdSlice))
+	case "stats":
+		return s.Store.LockAll(false)
+	case "flush_all":
+		return s.Store.LockAll(true)
+	}
 
-			var i int = 0
-			for i < 1 {
-				for k := range *s.Store.Db {
-					delete(*s.Store.Db, k)
-					i++
-				}
-			}
-			i = 0
-			break
-		} else {
-			msgStruct.Cmd = types.ServerCmd{
-				Command:   cmd.Command,
-				DataBlock: cmd.DataBlock,
-			}
-			msgStruct.RemoteAddr = conn.RemoteAddr()
-			cmdSlice := strings.Split(msgStruct.Cmd.Command, " ")
-			msgStruct.TimeStamp = time.Now().Format(time.ANSIC)
-			msgStruct.Text = fmt.Sprintf("%s %s %s %s %s\n", cmdSlice[0], cmdSlice[1], cmdSlice[2], cmdSlice[4], msgStruct.Cmd.DataBlock)
+	return func() {}
+}
 
-			result := handleSetData(*cmd, s.Store)
+// responseBuffer collects the responses of a command while the store is locked, so that a client that
+// is slow to read can't hold up everybody else
+type responseBuffer struct {
+	net.Conn
+	buf bytes.Buffer
+}
 
-			if strings.TrimSpace(result) == "END" {
-				msgStruct.Text = fmt.Sprintf("%s %s: Failed! The key %s already exists!\n", cmdSlice[0], strings.TrimSpace(msgStruct.Cmd.DataBlock), cmdSlice[1])
-			}
+func (r *responseBuffer) Write(b []byte) (int, error) {
+	return r.buf.Write(b)
+}
 
-			s.MsgCh <- *msgStruct
+func (r *responseBuffer) flush() {
+	if r.buf.Len() > 0 {
+		r.Conn.Write(r.buf.Bytes())
+	}
+}
 
-			conn.Write([]byte(result))
-			msgStruct.Cmd.Command = ""
-			msgStruct.Cmd.DataBlock = ""
-			cmd.Command = ""
-			cmd.DataBlock = ""
-		}
+// logging reports whether commands are logged, callers check it before building a message so that nothing
+// gets formatted with the command log turned off
+func (s *Server) logging() bool {
+	return s.verbosity.Load() > 0
+}
 
-	case parsedCmd[0] == "replace" && cmd.DataBlock != "":
-		msgStruct.Cmd = types.ServerCmd{
-			Command:   cmd.Command,
-			DataBlock: cmd.DataBlock,
-		}
-		msgStruct.RemoteAddr = conn.RemoteAddr()
-		cmdSlice := strings.Split(msgStruct.Cmd.Command, " ")
-		msgStruct.TimeStamp = time.Now().Format(time.ANSIC)
-		msgStruct.Text = fmt.Sprintf("%s %s %s %s %s\n", cmdSlice[0], cmdSlice[1], cmdSlice[2], cmdSlice[4], msgStruct.Cmd.DataBlock)
+// sendMessage puts a message about the command on the message queue so that it gets written to the log file,
+// the data block is left out so that the message doesn't keep the value alive
+func (s *Server) sendMessage(conn net.Conn, cmd types.ServerCmd, text string) {
+	s.queueMessage(types.Message{
+		RemoteAddr: conn.RemoteAddr(),
+		Text:       text,
+		Cmd:        types.ServerCmd{Command: cmd.Command},
+		TimeStamp:  time.Now().Format(time.ANSIC),
+	})
+}
 
-		result := handleReplaceData(*cmd, s.Store)
+// commandParser runs the command, it returns false when the client has asked to close the connection
+func (s *Server) commandParser(cmd *types.ServerCmd, conn net.Conn) bool {
+	parsedCmd := strings.Fields(cmd.Command)
 
-		if strings.TrimSpace(result) == "NOT_STORED" {
-			msgStruct.Text = fmt.Sprintf("%s %s: Failed! Could not find that key!\n", cmdSlice[0], msgStruct.Cmd.DataBlock)
+	// unknown commands and commands that are missing arguments are answered with ERROR
+	if len(parsedCmd) == 0 || len(parsedCmd) < minTokens[parsedCmd[0]] {
+		conn.Write([]byte("ERROR\r\n"))
+		return true
+	}
+
+	switch parsedCmd[0] != "" {
+	case parsedCmd[0] == "set":
+		result := handleSetData(*cmd, s.Store)
+
+		if s.logging() {
+			s.sendMessage(conn, *cmd, fmt.Sprintf("%s %s %s %s bytes\n", parsedCmd[0], parsedCmd[1], parsedCmd[2], parsedCmd[4]))
 		}
 
-		s.MsgCh <- *msgStruct
+		conn.Write([]byte(result))
+
+	case parsedCmd[0] == "get" || parsedCmd[0] == "gets":
+		result := handleGetData(parsedCmd, s.Store, parsedCmd[0] == "gets")
+
+		if s.logging() {
+			if strings.HasPrefix(result, "VALUE") {
+				// only the first VALUE line is logged, the values themselves are left out of the log
+				s.sendMessage(conn, *cmd, fmt.Sprintf("%s: %s\n", parsedCmd[0], strings.SplitN(result, "\r\n", 2)[0]))
+			} else {
+				s.sendMessage(conn, *cmd, fmt.Sprintf("%s: Failed! Key not found!\n", parsedCmd[0]))
+			}
+		}
 
 		conn.Write([]byte(result))
-		cmd.Command = ""
-		cmd.DataBlock = ""
 
-	case parsedCmd[0] == "append" && cmd.DataBlock != "":
-		msgStruct.Cmd = types.ServerCmd{
-			Command:   cmd.Command,
-			DataBlock: cmd.DataBlock,
+	case parsedCmd[0] == "add" || parsedCmd[0] == "replace":
+		result := handleSetData(*cmd, s.Store)
+
+		if s.logging() {
+			if strings.TrimSpace(result) != "NOT_STORED" {
+				s.sendMessage(conn, *cmd, fmt.Sprintf("%s %s %s %s bytes\n", parsedCmd[0], parsedCmd[1], parsedCmd[2], parsedCmd[4]))
+			} else if parsedCmd[0] == "add" {
+				s.sendMessage(conn, *cmd, fmt.Sprintf("%s: Failed! The key %s already exists!\n", parsedCmd[0], parsedCmd[1]))
+			} else {
+				s.sendMessage(conn, *cmd, fmt.Sprintf("%s %s: Failed! Could not find that key!\n", parsedCmd[0], parsedCmd[1]))
+			}
 		}
-		msgStruct.RemoteAddr = conn.RemoteAddr()
-		cmdSlice := strings.Split(msgStruct.Cmd.Command, " ")
-		msgStruct.TimeStamp = time.Now().Format(time.ANSIC)
-		msgStruct.Text = fmt.Sprintf("%s %s %s %s %s\n", cmdSlice[0], cmdSlice[1], cmdSlice[2], cmdSlice[4], msgStruct.Cmd.DataBlock)
 
+		conn.Write([]byte(result))
+
+	case parsedCmd[0] == "append" || parsedCmd[0] == "prepend":
 		result := handleAppendData(*cmd, s.Store)
 
-		if strings.TrimSpace(result) == "NOT_STORED" {
-			msgStruct.Text = fmt.Sprintf("%s %s: Failed! Could not find that key!\n", cmdSlice[0], msgStruct.Cmd.DataBlock)
+		if s.logging() {
+			if strings.TrimSpace(result) == "NOT_STORED" {
+				s.sendMessage(conn, *cmd, fmt.Sprintf("%s %s: Failed! Could not find that key!\n", parsedCmd[0], parsedCmd[1]))
+			} else {
+				s.sendMessage(conn, *cmd, fmt.Sprintf("%s %s %s %s bytes\n", parsedCmd[0], parsedCmd[1], parsedCmd[2], parsedCmd[4]))
+			}
 		}
 
-		s.MsgCh <- *msgStruct
+		conn.Write([]byte(result))
+
+	case parsedCmd[0] == "cas":
+		result := handleCasData(*cmd, s.Store)
+
+		if s.logging() {
+			if strings.TrimSpace(result) == "EXISTS" {
+				s.sendMessage(conn, *cmd, fmt.Sprintf("%s %s: Failed! The item has been modified since it was fetched!\n", parsedCmd[0], parsedCmd[1]))
+			} else if strings.TrimSpace(result) == "NOT_FOUND" {
+				s.sendMessage(conn, *cmd, fmt.Sprintf("%s %s: Failed! Could not find that key!\n", parsedCmd[0], parsedCmd[1]))
+			} else {
+				s.sendMessage(conn, *cmd, fmt.Sprintf("%s %s %s %s bytes\n", parsedCmd[0], parsedCmd[1], parsedCmd[2], parsedCmd[4]))
+			}
+		}
 
 		conn.Write([]byte(result))
-		cmd.Command = ""
-		cmd.DataBlock = ""
 
-	case parsedCmd[0] == "prepend" && cmd.DataBlock != "":
-		msgStruct.Cmd = types.ServerCmd{
-			Command:   cmd.Command,
-			DataBlock: cmd.DataBlock,
+	case parsedCmd[0] == "delete":
+		result := handleDeleteData(*cmd, s.Store)
+
+		if s.logging() {
+			if strings.TrimSpace(result) == "NOT_FOUND" {
+				s.sendMessage(conn, *cmd, fmt.Sprintf("%s %s: Failed! Could not find that key!\n", parsedCmd[0], parsedCmd[1]))
+			} else {
+				s.sendMessage(conn, *cmd, fmt.Sprintf("%s %s\n", parsedCmd[0], parsedCmd[1]))
+			}
 		}
-		msgStruct.RemoteAddr = conn.RemoteAddr()
-		cmdSlice := strings.Split(msgStruct.Cmd.Command, " ")
-		msgStruct.TimeStamp = time.Now().Format(time.ANSIC)
-		msgStruct.Text = fmt.Sprintf("%s %s %s %s %s\n", cmdSlice[0], cmdSlice[1], cmdSlice[2], cmdSlice[4], msgStruct.Cmd.DataBlock)
 
-		result := handlePrependData(*cmd, s.Store)
+		conn.Write([]byte(result))
+
+	case parsedCmd[0] == "touch":
+		result := handleTouchData(*cmd, s.Store)
 
-		if strings.TrimSpace(result) == "NOT_STORED" {
-			msgStruct.Text = fmt.Sprintf("%s %s: Failed! Could not find that key!\n", cmdSlice[0], msgStruct.Cmd.DataBlock)
+		if s.logging() {
+			if strings.TrimSpace(result) == "NOT_FOUND" {
+				s.sendMessage(conn, *cmd, fmt.Sprintf("%s: Failed! Could not find that key!\n", cmd.Command))
+			} else {
+				s.sendMessage(conn, *cmd, fmt.Sprintf("%s\n", cmd.Command))
+			}
 		}
 
-		s.MsgCh <- *msgStruct
+		conn.Write([]byte(result))
+
+	case parsedCmd[0] == "gat" || parsedCmd[0] == "gats":
+		result := handleGatData(*cmd, s.Store)
+
+		if s.logging() {
+			s.sendMessage(conn, *cmd, fmt.Sprintf("%s\n", cmd.Command))
+		}
 
 		conn.Write([]byte(result))
-		cmd.Command = ""
-		cmd.DataBlock = ""
 
-	case parsedCmd[0] == "delete":
-		msgStruct.Cmd = types.ServerCmd{
-			Command:   cmd.Command,
-			DataBlock: cmd.DataBlock,
+	case parsedCmd[0] == "flush_all":
+		result := handleFlushAllData(*cmd, s.Store)
+
+		if s.logging() {
+			s.sendMessage(conn, *cmd, fmt.Sprintf("%s\n", cmd.Command))
 		}
-		msgStruct.RemoteAddr = conn.RemoteAddr()
-		cmdSlice := strings.Split(msgStruct.Cmd.Command, " ")
-		msgStruct.TimeStamp = time.Now().Format(time.ANSIC)
-		msgStruct.Text = fmt.Sprintf("%s %s\n", cmdSlice[0], cmdSlice[1])
 
-		result := handleDeleteData(*cmd, s.Store)
+		conn.Write([]byte(result))
+
+	case parsedCmd[0] == "stats":
+		result := s.handleStats(*cmd)
+
+		conn.Write([]byte(result))
+
+	case parsedCmd[0] == "incr" || parsedCmd[0] == "decr":
+		result := handleIncrDecrData(*cmd, s.Store)
 
-		if strings.TrimSpace(result) == "END" {
-			msgStruct.Text = fmt.Sprintf("%s %s: Failed! Could not find that key!\n", cmdSlice[0], msgStruct.Cmd.DataBlock)
+		if s.logging() {
+			if strings.TrimSpace(result) == "NOT_FOUND" {
+				s.sendMessage(conn, *cmd, fmt.Sprintf("%s: Failed! Could not find that key!\n", cmd.Command))
+			} else {
+				s.sendMessage(conn, *cmd, fmt.Sprintf("%s: %s\n", cmd.Command, strings.TrimSpace(result)))
+			}
 		}
 
-		s.MsgCh <- *msgStruct
+		conn.Write([]byte(result))
+
+	case parsedCmd[0] == "mg" || parsedCmd[0] == "ms" || parsedCmd[0] == "md" || parsedCmd[0] == "ma" || parsedCmd[0] == "mn" || parsedCmd[0] == "me":
+		result := handleMetaCommand(*cmd, s.Store)
+
+		if s.logging() {
+			s.sendMessage(conn, *cmd, fmt.Sprintf("%s: %s\n", cmd.Command, strings.SplitN(result, "\r\n", 2)[0]))
+		}
 
 		conn.Write([]byte(result))
-		cmd.Command = ""
-		cmd.DataBlock = ""
 
-	case parsedCmd[0] == "increment" && cmd.DataBlock != "":
-		result := handleIncrementStoreSize(*cmd, s.Store)
+	case parsedCmd[0] == "version":
+		conn.Write([]byte(fmt.Sprintf("VERSION %s\r\n", Version)))
+
+	case parsedCmd[0] == "verbosity":
+		result := s.handleVerbosity(*cmd)
+
 		conn.Write([]byte(result))
-		cmd.Command = ""
-		cmd.DataBlock = ""
 
-	case parsedCmd[0] == "decrement" && cmd.DataBlock != "":
-		result := handleDecrementStoreSize(*cmd, s.Store)
+	case parsedCmd[0] == "snapshot":
+		result := "OK\r\n"
+
+		if err := s.Snapshot(); err != nil {
+			result = fmt.Sprintf("SERVER_ERROR %v\r\n", err)
+		}
+
+		if s.logging() {
+			s.sendMessage(conn, *cmd, fmt.Sprintf("%s: %s\n", cmd.Command, strings.TrimSpace(result)))
+		}
+
 		conn.Write([]byte(result))
-		cmd.Command = ""
-		cmd.DataBlock = ""
+
+	case parsedCmd[0] == "quit":
+		if s.logging() {
+			s.sendMessage(conn, *cmd, fmt.Sprintf("%s\n", cmd.Command))
+		}
+
+		return false
+
+	default:
+		conn.Write([]byte("ERROR\r\n"))
 	}
+
+	return true
 }
 
-func handleSetData(data types.ServerCmd, store *types.Store) string {
-	cmdSlice := strings.Split(data.Command, " ")
-	flags, fErr := strconv.Atoi(strings.TrimSpace(cmdSlice[2]))
-	key := cmdSlice[1]
+// SetVerbosity sets the logging level like the verbosity command, 0 turns the command log off
+func (s *Server) SetVerbosity(level int) {
+	s.verbosity.Store(int32(level))
+}
 
-	if strings.TrimSpace(cmdSlice[0]) == "add" || strings.TrimSpace(cmdSlice[0]) == "set" {
-		for k := range *store.Db {
-			if k == key {
-				return "END\r\n"
-			}
-		}
+// handleVerbosity handles "verbosity <level> [noreply]" which sets the logging level of the server
+func (s *Server) handleVerbosity(cmd types.ServerCmd) string {
+	cmdSlice := strings.Fields(cmd.Command)
+
+	noreply := cmdSlice[len(cmdSlice)-1] == "noreply"
+
+	level, err := strconv.ParseInt(cmdSlice[1], 10, 32)
+
+	if err != nil || level < 0 {
+		return "CLIENT_ERROR bad command line format\r\n"
 	}
 
-	if fErr != nil {
-		return "Error: Flags field is missing or not a valid number, please try again\r\n"
+	s.SetVerbosity(int(level))
+
+	if noreply {
+		return ""
 	}
 
-	byteCt, bCtErr := strconv.Atoi(strings.TrimSpace(cmdSlice[4]))
+	return "OK\r\n"
+}
+
+// parseStorageCommand builds the item for a "<command> <key> <flags> <exptime> <bytes> [cas unique] [noreply]"
+// command line, if the line is invalid the returned string holds the response for the client
+func parseStorageCommand(data types.ServerCmd) (*types.DataArgs, string) {
+	cmdSlice := strings.Fields(data.Command)
+	flags, fErr := strconv.ParseUint(cmdSlice[2], 10, 32)
+	key := cmdSlice[1]
 
-	if bCtErr != nil {
-		return "Error: Byte Count field is missing or not a valid number, please try again\r\n"
+	if fErr != nil {
+		return nil, "CLIENT_ERROR bad command line format\r\n"
 	}
 
-	expTime, expErr := strconv.ParseInt(strings.TrimSpace(cmdSlice[3]), 0, 64)
+	expTime, expErr := strconv.ParseInt(cmdSlice[3], 10, 64)
 
 	if expErr != nil {
-		return "Error: Exptime field is missing or not a valid number, please try again\r\n"
+		return nil, "CLIENT_ERROR bad command line format\r\n"
+	}
+
+	// cas has the cas unique before the optional noreply
+	noreplyIdx := 5
+
+	if strings.TrimSpace(cmdSlice[0]) == "cas" {
+		noreplyIdx = 6
 	}
 
 	var noreply bool
 
-	if len(cmdSlice) < 6 {
+	if len(cmdSlice) <= noreplyIdx {
 		noreply = false
-	} else if strings.TrimSpace(cmdSlice[5]) == "noreply" {
+	} else if strings.TrimSpace(cmdSlice[noreplyIdx]) == "noreply" {
 		noreply = true
 	}
 
-	var expirationTime int64
+	expirationTime := convertExptime(expTime)
 
-	if expTime == 0 {
-		expirationTime = 0
-	} else if expTime > 0 {
-		expirationTime = time.Now().Unix() + expTime
-	} else if expTime < 0 {
-		expirationTime = -1
+	// the byte count in the command line has already been used to read the data block off of the
+	// connection, so we store the length of the data we actually received
+	if len(key) > maxKeyLength {
+		return nil, "CLIENT_ERROR bad command line format\r\n"
 	}
 
-	// handle if flags and byte are undefined
 	dataArgs := &types.DataArgs{
+		Key:       key,
 		DataBlock: data.DataBlock,
-		Flags:     flags,
+		Flags:     int(flags),
 		Exptime:   expirationTime,
-		ByteCt:    byteCt,
+		ByteCt:    len(data.DataBlock),
 		Noreply:   noreply,
 	}
 
-	(*store.Db)[key] = dataArgs
+	return dataArgs, ""
+}
 
-	if noreply {
-		return ""
+func handleSetData(data types.ServerCmd, store types.Storage) string {
+	store.Stats().CmdSet.Add(1)
+
+	dataArgs, errResult := parseStorageCommand(data)
+
+	if dataArgs == nil {
+		return errResult
+	}
+
+	var err error
+
+	switch strings.TrimSpace(strings.Fields(data.Command)[0]) {
+	case "add":
+		err = store.Add(dataArgs)
+	case "replace":
+		err = store.Replace(dataArgs)
+	default:
+		err = store.Set(dataArgs)
 	}
 
-	return "STORED\r\n"
+	return storageResult(dataArgs, err)
 }
 
-func handleGetData(cmdString []string, store *types.Store) string {
-	key := strings.TrimSpace(cmdString[1])
-	var result string
+// storageResult turns the outcome of storing the item into the response of a storage command
+func storageResult(item *types.DataArgs, err error) string {
+	switch err {
+	case nil:
+		return noreplyResult(item, "STORED\r\n")
+	case types.ErrNotStored:
+		return noreplyResult(item, "NOT_STORED\r\n")
+	case types.ErrNotFound:
+		return noreplyResult(item, "NOT_FOUND\r\n")
+	case types.ErrExists:
+		return noreplyResult(item, "EXISTS\r\n")
+	}
 
-	if len((*store.Db)) == 0 {
-		return "END\r\n"
-	} else if len((*store.Db)) > 0 {
-		for k, v := range *store.Db {
-			if key == strings.TrimSpace(k) {
-				exp := v.Exptime
+	return fmt.Sprintf("SERVER_ERROR %v\r\n", err)
+}
 
-				if exp == 0 {
-					result = fmt.Sprintf("VALUE %s %d %d\n%s\n", k, v.Flags, v.ByteCt, strings.TrimSpace(v.DataBlock))
-					return result
-				} else if time.Now().Unix() > exp || exp < 0 {
-					delete(*store.Db, k)
-					result = "END\r\n"
-					return result
-				}
+func handleCasData(data types.ServerCmd, store types.Storage) string {
+	cmdSlice := strings.Fields(data.Command)
 
-				result = fmt.Sprintf("VALUE %s %d %d\n%s\n", k, v.Flags, v.ByteCt, strings.TrimSpace(v.DataBlock))
-			} else if key == strings.TrimSpace(key) {
-				result = "END\r\n"
-			}
-		}
+	if len(cmdSlice) < 6 {
+		return "CLIENT_ERROR bad command line format\r\n"
 	}
 
-	return result
+	casUnique, cErr := strconv.ParseUint(strings.TrimSpace(cmdSlice[5]), 10, 64)
+
+	if cErr != nil {
+		return "CLIENT_ERROR bad command line format\r\n"
+	}
+
+	dataArgs, errResult := parseStorageCommand(data)
+
+	if dataArgs == nil {
+		return errResult
+	}
+
+	store.Stats().CmdSet.Add(1)
+
+	err := store.CAS(dataArgs, casUnique)
+
+	switch err {
+	case types.ErrNotFound:
+		store.Stats().CasMisses.Add(1)
+	case types.ErrExists:
+		// somebody else has modified the item since the client fetched it
+		store.Stats().CasBadval.Add(1)
+	default:
+		store.Stats().CasHits.Add(1)
+	}
+
+	return storageResult(dataArgs, err)
 }
 
-func handleAddData(cmd types.ServerCmd, store *types.Store) string {
-	cmdSlice := strings.Split(cmd.Command, " ")
-	key := cmdSlice[1]
+// maxRelativeExptime is the largest exptime that is taken as an amount of seconds, like memcached larger
+// ones are a unix time
+const maxRelativeExptime = 60 * 60 * 24 * 30
 
-	for k := range *store.Db {
-		if k == "" {
-			result := handleSetData(cmd, store)
-			return result
-		} else if key != k {
-			result := handleSetData(cmd, store)
-			return result
-		} else if string(key) == k {
-			return "NOT_STORED\r\n"
-		}
+// convertExptime turns the exptime sent by the client into the unix time the item expires at,
+// 0 means the item never expires and -1 that it is expired immediately. An exptime of more than 30 days
+// is a unix time already, one that has passed expires the item immediately
+func convertExptime(expTime int64) int64 {
+	var expirationTime int64
+	now := time.Now().Unix()
+
+	if expTime == 0 {
+		expirationTime = 0
+	} else if expTime > maxRelativeExptime && expTime <= now {
+		expirationTime = -1
+	} else if expTime > maxRelativeExptime {
+		expirationTime = expTime
+	} else if expTime > 0 {
+		expirationTime = now + expTime
+	} else if expTime < 0 {
+		expirationTime = -1
 	}
 
-	return ""
+	return expirationTime
 }
 
-func handleReplaceData(cmd types.ServerCmd, store *types.Store) string {
-	cmdSlice := strings.Split(cmd.Command, " ")
-	key := cmdSlice[1]
+// noreplyResult suppresses the response when the client asked for noreply
+func noreplyResult(item *types.DataArgs, result string) string {
+	if item.Noreply {
+		return ""
+	}
 
-	for k := range *store.Db {
-		if k == "" {
-			result := handleSetData(cmd, store)
-			return result
-		} else if string(key) != k {
-			return "NOT_STORED\r\n"
-		} else if string(key) == k {
-			flags, fErr := strconv.Atoi(strings.TrimSpace(cmdSlice[2]))
-
-			if fErr != nil {
-				return "Error: Flags field is missing or not a valid number, please try again\r\n"
-			}
+	return result
+}
 
-			byteCt, bCtErr := strconv.Atoi(strings.TrimSpace(cmdSlice[4]))
+// handleGetData handles "get|gets <key>*", gets also returns the cas unique of the items
+func handleGetData(cmdString []string, store types.Storage, withCas bool) string {
+	return retrieveItems(strings.Fields(strings.Join(cmdString[1:], " ")), store, withCas, nil)
+}
 
-			if bCtErr != nil {
-				return "Error: Byte Count field is missing or not a valid number, please try again\r\n"
-			}
+// retrieveItems builds a VALUE block for every key that is found, in the order of the keys, followed by a
+// single END. If exptime is set the expiration time of every found item is updated to it
+func retrieveItems(keys []string, store types.Storage, withCas bool, exptime *int64) string {
+	if len(keys) == 0 {
+		return "ERROR\r\n"
+	}
 
-			expTime, expErr := strconv.ParseInt(strings.TrimSpace(cmdSlice[3]), 0, 64)
+	for _, key := range keys {
+		if len(key) > maxKeyLength {
+			return "CLIENT_ERROR bad command line format\r\n"
+		}
+	}
 
-			if expErr != nil {
-				return "Error: Exptime field is missing or not a valid number, please try again\r\n"
-			}
+	var result strings.Builder
 
-			var noreply bool
+	for _, key := range keys {
+		store.Stats().CmdGet.Add(1)
 
-			if len(cmdSlice) < 6 {
-				noreply = false
-			} else if strings.TrimSpace(cmdSlice[5]) == "noreply" {
-				noreply = true
-			}
+		if exptime != nil {
+			store.Stats().CmdTouch.Add(1)
+		}
 
-			var expirationTime int64
+		var item *types.DataArgs
+		var ok bool
 
-			if expTime == 0 {
-				expirationTime = 0
-			} else if expTime > 0 {
-				expirationTime = time.Now().Unix() + expTime
-			} else if expTime < 0 {
-				expirationTime = -1
-			}
+		if exptime != nil {
+			item, ok = store.Touch(key, convertExptime(*exptime))
+		} else {
+			item, ok = store.Get(key)
+		}
+
+		if !ok {
+			store.Stats().GetMisses.Add(1)
 
-			// handle if flags and byte are undefined
-			dataArgs := &types.DataArgs{
-				DataBlock: cmd.DataBlock,
-				Flags:     flags,
-				Exptime:   expirationTime,
-				ByteCt:    byteCt,
-				Noreply:   noreply,
+			if exptime != nil {
+				store.Stats().TouchMisses.Add(1)
 			}
 
-			(*store.Db)[key] = dataArgs
+			continue
+		}
 
-			if noreply {
-				return ""
-			}
+		store.Stats().GetHits.Add(1)
 
-			return "STORED\r\n"
+		if exptime != nil {
+			store.Stats().TouchHits.Add(1)
 		}
+
+		result.WriteString(formatValue(item, withCas))
 	}
 
-	return ""
+	result.WriteString("END\r\n")
+
+	return result.String()
 }
 
-func handleAppendData(cmd types.ServerCmd, store *types.Store) string {
-	// add being able to add a space in the datablock string
-	key := strings.TrimSpace(strings.Split(cmd.Command, " ")[1])
-	var result string
+// formatValue builds the VALUE line and data block that is returned for a retrieved item
+func formatValue(item *types.DataArgs, withCas bool) string {
+	if withCas {
+		return fmt.Sprintf("VALUE %s %d %d %d\r\n%s\r\n", item.Key, item.Flags, item.ByteCt, item.Cas, item.DataBlock)
+	}
+
+	return fmt.Sprintf("VALUE %s %d %d\r\n%s\r\n", item.Key, item.Flags, item.ByteCt, item.DataBlock)
+}
 
-	if len(*store.Db) == 0 {
-		return "NOT_STORED\r\n"
+// handleTouchData handles "touch <key> <exptime> [noreply]" which updates the expiration time of an
+// item without having to send the value again
+func handleTouchData(cmd types.ServerCmd, store types.Storage) string {
+	cmdSlice := strings.Fields(cmd.Command)
+
+	if len(cmdSlice) < 3 {
+		return "CLIENT_ERROR bad command line format\r\n"
 	}
 
-	for k, v := range *store.Db {
-		if k == strings.TrimSpace(key) {
-			(*store.Db)[key].DataBlock = strings.TrimSpace(v.DataBlock) + " " + strings.TrimSpace(cmd.DataBlock)
-			result = "STORED\r\n"
-			return result
-		} else if k != key {
-			result = "NOT_STORED\r\n"
-			return result
-		}
+	noreply := len(cmdSlice) > 3 && cmdSlice[3] == "noreply"
+
+	expTime, expErr := strconv.ParseInt(cmdSlice[2], 10, 64)
+
+	if expErr != nil {
+		return "CLIENT_ERROR invalid exptime argument\r\n"
+	}
+
+	store.Stats().CmdTouch.Add(1)
+
+	result := "NOT_FOUND\r\n"
+
+	if _, ok := store.Touch(cmdSlice[1], convertExptime(expTime)); ok {
+		result = "TOUCHED\r\n"
+		store.Stats().TouchHits.Add(1)
+	} else {
+		store.Stats().TouchMisses.Add(1)
+	}
+
+	if noreply {
+		return ""
 	}
 
 	return result
 }
 
-func handlePrependData(cmd types.ServerCmd, store *types.Store) string {
-	// add being able to add a space in the datablock string
-	key := strings.TrimSpace(strings.Split(cmd.Command, " ")[1])
-	var result string
+// handleFlushAllData handles "flush_all [delay] [noreply]", without a delay every item is removed right
+// away, with a delay every item that was stored before the flush point becomes invalid once it is reached
+func handleFlushAllData(cmd types.ServerCmd, store types.Storage) string {
+	cmdSlice := strings.Fields(cmd.Command)
+
+	noreply := cmdSlice[len(cmdSlice)-1] == "noreply"
 
-	if len(*store.Db) == 0 {
-		return "NOT_STORED\r\n"
+	if noreply {
+		cmdSlice = cmdSlice[:len(cmdSlice)-1]
 	}
 
-	for k, v := range *store.Db {
-		if k == strings.TrimSpace(key) {
-			(*store.Db)[key].DataBlock = strings.TrimSpace(cmd.DataBlock) + " " + strings.TrimSpace(v.DataBlock)
-			result = "STORED\r\n"
-		} else if k != key {
-			result = "NOT_STORED\r\n"
-			return result
+	var delay int64
+
+	if len(cmdSlice) > 1 {
+		d, dErr := strconv.ParseInt(cmdSlice[1], 10, 64)
+
+		if dErr != nil || d < 0 {
+			return "CLIENT_ERROR bad command line format\r\n"
 		}
+
+		delay = d
 	}
 
-	return result
+	store.Stats().CmdFlush.Add(1)
+
+	store.Flush(delay)
+
+	if noreply {
+		return ""
+	}
+
+	return "OK\r\n"
 }
 
-func handleDeleteData(cmd types.ServerCmd, store *types.Store) string {
-	cmdSlice := strings.Split(cmd.Command, " ")
-	result := ""
+// handleGatData handles "gat|gats <exptime> <key>*", it works like get and gets but also updates the
+// expiration time of every item that is found
+func handleGatData(cmd types.ServerCmd, store types.Storage) string {
+	cmdSlice := strings.Fields(cmd.Command)
+
+	if len(cmdSlice) < 3 {
+		return "CLIENT_ERROR bad command line format\r\n"
+	}
+
+	expTime, expErr := strconv.ParseInt(cmdSlice[1], 10, 64)
+
+	if expErr != nil {
+		return "CLIENT_ERROR invalid exptime argument\r\n"
+	}
+
+	return retrieveItems(cmdSlice[2:], store, cmdSlice[0] == "gats", &expTime)
+}
+
+// handleAppendData handles "append|prepend <key> <flags> <exptime> <bytes> [noreply]", the flags and
+// exptime of the stored item are kept
+func handleAppendData(cmd types.ServerCmd, store types.Storage) string {
+	cmdSlice := strings.Fields(cmd.Command)
+	key := strings.TrimSpace(cmdSlice[1])
+
+	store.Stats().CmdSet.Add(1)
+
+	var err error
+
+	if cmdSlice[0] == "prepend" {
+		_, err = store.Prepend(key, cmd.DataBlock)
+	} else {
+		_, err = store.Append(key, cmd.DataBlock)
+	}
+
+	return storageResult(&types.DataArgs{Key: key, Noreply: cmdSlice[len(cmdSlice)-1] == "noreply"}, err)
+}
+
+// handleDeleteData handles "delete <key> [noreply]"
+func handleDeleteData(cmd types.ServerCmd, store types.Storage) string {
+	cmdSlice := strings.Fields(cmd.Command)
 	keyToDelete := cmdSlice[1]
 
-	if len((*store.Db)) == 0 {
-		return "END\r\n"
+	noreply := len(cmdSlice) > 2 && cmdSlice[len(cmdSlice)-1] == "noreply"
+
+	result := "NOT_FOUND\r\n"
+
+	if store.Delete(keyToDelete) {
+		store.Stats().DeleteHits.Add(1)
+		result = "DELETED\r\n"
+	} else {
+		store.Stats().DeleteMiss.Add(1)
 	}
 
-	for k := range *store.Db {
-		if strings.TrimSpace(keyToDelete) == k {
-			delete(*store.Db, k)
-			result = "DELETED\r\n"
-			return result
-		} else if keyToDelete != k {
-			result = "END\r\n"
-		}
+	if noreply {
+		return ""
 	}
 
 	return result
 }
 
-func handleIncrementStoreSize(cmd types.ServerCmd, store *types.Store) string {
-	incrementValue, err := strconv.Atoi(cmd.DataBlock)
+// handleIncrDecrData handles "incr|decr <key> <value> [noreply]", the item value is treated as a 64-bit
+// unsigned decimal, incr wraps around on overflow and decr stops at 0
+func handleIncrDecrData(cmd types.ServerCmd, store types.Storage) string {
+	cmdSlice := strings.Fields(cmd.Command)
 
-	if err != nil {
-		return fmt.Sprintf("Error: %s\n", err)
+	if len(cmdSlice) < 3 {
+		return "CLIENT_ERROR bad command line format\r\n"
 	}
 
-	store.Size += incrementValue
+	noreply := len(cmdSlice) > 3 && cmdSlice[3] == "noreply"
 
-	return "INCREMENT\r\n"
-}
+	delta, dErr := strconv.ParseUint(cmdSlice[2], 10, 64)
+
+	if dErr != nil {
+		return "CLIENT_ERROR invalid numeric delta argument\r\n"
+	}
 
-func handleDecrementStoreSize(cmd types.ServerCmd, store *types.Store) string {
-	decrementValue, err := strconv.Atoi(cmd.DataBlock)
+	hits, misses := &store.Stats().IncrHits, &store.Stats().IncrMisses
+	arithmetic := store.Incr
 
-	if err != nil {
-		return fmt.Sprintf("Error: %s\n", err)
+	if cmdSlice[0] == "decr" {
+		hits, misses = &store.Stats().DecrHits, &store.Stats().DecrMisses
+		arithmetic = store.Decr
 	}
 
-	store.Size += decrementValue
+	item, err := arithmetic(cmdSlice[1], delta)
+
+	switch err {
+	case nil:
+		hits.Add(1)
+	case types.ErrNotFound:
+		misses.Add(1)
+
+		if noreply {
+			return ""
+		}
+
+		return "NOT_FOUND\r\n"
+	case types.ErrNonNumeric:
+		hits.Add(1)
+		return fmt.Sprintf("CLIENT_ERROR %v\r\n", err)
+	default:
+		return fmt.Sprintf("SERVER_ERROR %v\r\n", err)
+	}
+
+	if noreply {
+		return ""
+	}
 
-	return "DECREMENT\r\n"
+	return fmt.Sprintf("%s\r\n", item.DataBlock)
 }
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultShutdownTimeout is the time the running commands get to finish when none is given with -shutdown-timeout
+const DefaultShutdownTimeout = 10 * time.Second
+
+// Shutdown stops the server gracefully. It closes the listener and the idle connections, lets the
+// commands that are running finish and closes their connections afterwards. Once the connections are
+// drained it stops the background goroutines, writes out the log queue and the operation log and takes
+// a snapshot when SnapshotOnShutdown is set. When the context is done before the connections are
+// drained, the remaining connections are closed and the context's error is returned after the rest of
+// the shutdown
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.peersMu.Lock()
+
+	if !s.shuttingDown.CompareAndSwap(false, true) {
+		s.peersMu.Unlock()
+		return ErrServerClosed
+	}
+
+	if s.Listener != nil {
+		s.Listener.Close()
+	}
+
+	// busy connections are closed by their own goroutine once the command has finished
+	for _, peer := range s.PeerMap {
+		if !peer.Busy {
+			peer.Conn.Close()
+		}
+	}
+
+	s.peersMu.Unlock()
+
+	err := waitContext(ctx, &s.conns)
+
+	if err != nil {
+		s.closeConnections()
+	}
+
+	close(s.quit)
+
+	if waitErr := waitContext(ctx, &s.background); waitErr != nil && err == nil {
+		err = waitErr
+	}
+
+	if s.opLog != nil {
+		if closeErr := s.opLog.close(); closeErr != nil {
+			fmt.Println("operation log error: ", closeErr)
+		}
+	}
+
+	if s.SnapshotOnShutdown {
+		if snapshotErr := s.Snapshot(); snapshotErr != nil && err == nil {
+			err = snapshotErr
+		}
+	}
+
+	return err
+}
+
+// closeConnections closes every connection, the commands that are still running can't answer anymore
+func (s *Server) closeConnections() {
+	s.peersMu.Lock()
+	defer s.peersMu.Unlock()
+
+	for _, peer := range s.PeerMap {
+		peer.Conn.Close()
+	}
+}
+
+// waitContext waits for the wait group until the context is done
+func waitContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	// the wait group may have finished right as the context was done
+	select {
+	case <-done:
+		return nil
+	default:
+		return ctx.Err()
+	}
+}
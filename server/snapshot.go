@@ -0,0 +1,314 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pschlafley/coding-challenges/go-memcache/types"
+)
+
+// DefaultSnapshotPath is the file the snapshots are written to and restored from when none is given with -snapshot-file
+const DefaultSnapshotPath = "./memcache.snapshot"
+
+// a snapshot file starts with the magic and the version of its format, followed by the point of a
+// pending delayed flush_all or 0, the items and a crc32 of everything before it
+const (
+	snapshotMagic   = "GMCS"
+	snapshotVersion = 3
+)
+
+// the bits of the state of an item, the meta protocol marks items as stale and remembers that a client
+// has been told to refill them
+const (
+	itemStale   byte = 1 << 0
+	itemWinSent byte = 1 << 1
+)
+
+var errBadSnapshot = errors.New("bad snapshot file")
+
+// appendItem encodes the item as
+// <key length uint16> <key> <flags uint32> <exptime int64> <cas uint64> <stored at int64> <state uint8>
+// <value length uint32> <value>
+func appendItem(buf []byte, item *types.DataArgs) []byte {
+	var state byte
+
+	if item.Stale {
+		state |= itemStale
+	}
+
+	if item.WinSent {
+		state |= itemWinSent
+	}
+
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(item.Key)))
+	buf = append(buf, item.Key...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(item.Flags))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(item.Exptime))
+	buf = binary.BigEndian.AppendUint64(buf, item.Cas)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(item.Time))
+	buf = append(buf, state)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(item.DataBlock)))
+
+	return append(buf, item.DataBlock...)
+}
+
+// readItem decodes an item that has been encoded with appendItem
+func readItem(r io.Reader) (*types.DataArgs, error) {
+	var keyLen uint16
+
+	if err := binary.Read(r, binary.BigEndian, &keyLen); err != nil {
+		return nil, err
+	}
+
+	key := make([]byte, keyLen)
+
+	if _, err := io.ReadFull(r, key); err != nil {
+		return nil, err
+	}
+
+	var header struct {
+		Flags    uint32
+		Exptime  int64
+		Cas      uint64
+		Time     int64
+		State    uint8
+		ValueLen uint32
+	}
+
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+
+	value := make([]byte, header.ValueLen)
+
+	if _, err := io.ReadFull(r, value); err != nil {
+		return nil, err
+	}
+
+	return &types.DataArgs{
+		Key:       string(key),
+		DataBlock: value,
+		Flags:     int(header.Flags),
+		Exptime:   header.Exptime,
+		ByteCt:    len(value),
+		Cas:       header.Cas,
+		Time:      header.Time,
+		Stale:     header.State&itemStale != 0,
+		WinSent:   header.State&itemWinSent != 0,
+	}, nil
+}
+
+// itemExpired reports whether an item loaded from disk has already expired
+func itemExpired(item *types.DataArgs, now int64) bool {
+	return item.Exptime < 0 || (item.Exptime > 0 && now > item.Exptime)
+}
+
+// itemFlushed reports whether the item was stored before the point of a delayed flush_all that has passed
+func itemFlushed(item *types.DataArgs, flushAt int64, now int64) bool {
+	return flushAt != 0 && now >= flushAt && item.Time < flushAt
+}
+
+// pendingFlush returns the point of the delayed flush_all of the store that hasn't passed yet, 0 when
+// there is none. A flush that has passed doesn't need to be kept since the items it invalidated are left out
+func pendingFlush(store types.Storage, now int64) int64 {
+	if at := store.FlushPoint(); at > now {
+		return at
+	}
+
+	return 0
+}
+
+// encodeSnapshot builds the snapshot file of the live items of the store, the store is only locked
+// while the items are copied
+func encodeSnapshot(store types.Storage) []byte {
+	unlock := store.LockAll(false)
+	buf := snapshotItems(store, time.Now().Unix())
+	unlock()
+
+	return sealSnapshot(buf)
+}
+
+// snapshotItems copies the pending flush point and the live items of the store behind the header of a
+// snapshot file, the caller has to lock the store
+func snapshotItems(store types.Storage, now int64) []byte {
+	buf := append([]byte(snapshotMagic), 0, snapshotVersion)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(pendingFlush(store, now)))
+
+	flushAt := store.FlushPoint()
+
+	store.Range(func(item *types.DataArgs) bool {
+		if !itemExpired(item, now) && !itemFlushed(item, flushAt, now) {
+			buf = appendItem(buf, item)
+		}
+
+		return true
+	})
+
+	return buf
+}
+
+// sealSnapshot appends the checksum that ends a snapshot file
+func sealSnapshot(buf []byte) []byte {
+	return binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+}
+
+// decodeSnapshot checks the version and the checksum of the snapshot file and returns its items and the
+// point of its pending flush
+func decodeSnapshot(data []byte) ([]*types.DataArgs, int64, error) {
+	headerLen := len(snapshotMagic) + 2
+
+	if len(data) < headerLen+8+4 || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, 0, errBadSnapshot
+	}
+
+	if version := binary.BigEndian.Uint16(data[len(snapshotMagic):]); version != snapshotVersion {
+		return nil, 0, fmt.Errorf("%w: unsupported version %d", errBadSnapshot, version)
+	}
+
+	body, sum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, 0, fmt.Errorf("%w: checksum mismatch", errBadSnapshot)
+	}
+
+	flushAt := int64(binary.BigEndian.Uint64(body[headerLen:]))
+	r := bytes.NewReader(body[headerLen+8:])
+
+	var items []*types.DataArgs
+
+	for r.Len() > 0 {
+		item, err := readItem(r)
+
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: %v", errBadSnapshot, err)
+		}
+
+		items = append(items, item)
+	}
+
+	return items, flushAt, nil
+}
+
+// writeFileAtomic writes the data to a temporary file next to the path and renames it into place, so
+// the file at the path is either the old or the new one even if the server crashes while writing
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Snapshot writes every live item of the store to the snapshot file
+func (s *Server) Snapshot() error {
+	return writeFileAtomic(s.SnapshotPath, encodeSnapshot(s.Store))
+}
+
+// itemDoesNotFit reports whether an item couldn't be stored because there is no room for it, like an
+// item loaded from disk by a server that was started with a lower memory limit or item size limit
+func itemDoesNotFit(err error) bool {
+	return err == types.ErrTooLarge || err == types.ErrOutOfMemory
+}
+
+// Restore loads the items of the snapshot file into the store, items that have expired since the
+// snapshot was taken are dropped and a pending flush is restored with the times the items were
+// stored at. It returns the amount of items that were restored and the amount of items that were
+// skipped because they don't fit into the store
+func (s *Server) Restore() (int, int, error) {
+	data, err := os.ReadFile(s.SnapshotPath)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	items, flushAt, err := decodeSnapshot(data)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	now := time.Now().Unix()
+	restored, skipped := 0, 0
+
+	unlock := s.Store.LockAll(true)
+	defer unlock()
+
+	if flushAt != 0 {
+		s.Store.RestoreFlush(flushAt)
+	}
+
+	for _, item := range items {
+		if itemExpired(item, now) {
+			continue
+		}
+
+		err := s.Store.Restore(item)
+
+		if itemDoesNotFit(err) {
+			skipped++
+			continue
+		}
+
+		if err != nil {
+			return restored, skipped, err
+		}
+
+		restored++
+	}
+
+	return restored, skipped, nil
+}
+
+// RunSnapshots writes a snapshot every interval in the background until the server quits, Shutdown waits
+// for a snapshot that is still being written before it takes the last one
+func (s *Server) RunSnapshots(interval time.Duration) {
+	s.background.Add(1)
+
+	go func() {
+		defer s.background.Done()
+		s.runSnapshots(interval)
+	}()
+}
+
+// runSnapshots writes a snapshot every interval until the server quits
+func (s *Server) runSnapshots(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-ticker.C:
+		}
+
+		if err := s.Snapshot(); err != nil {
+			fmt.Println("snapshot error: ", err)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pschlafley/coding-challenges/go-memcache/types"
+)
+
+// sizeBucket is the granularity of the item size histogram returned by "stats sizes"
+const sizeBucket = 32
+
+// stat is a single "STAT <name> <value>" line of a stats response
+type stat struct {
+	name  string
+	value any
+}
+
+// handleStats handles "stats [items|slabs|settings|sizes|conns|replication]"
+func (s *Server) handleStats(cmd types.ServerCmd) string {
+	cmdSlice := strings.Fields(cmd.Command)
+
+	group := ""
+
+	if len(cmdSlice) > 1 {
+		group = cmdSlice[1]
+	}
+
+	stats, ok := s.statsGroup(group)
+
+	if !ok {
+		return "ERROR\r\n"
+	}
+
+	var result strings.Builder
+
+	for _, st := range stats {
+		result.WriteString(fmt.Sprintf("STAT %s %v\r\n", st.name, st.value))
+	}
+
+	result.WriteString("END\r\n")
+
+	return result.String()
+}
+
+// statsGroup returns the stats of the group, the general stats are returned for an empty group
+func (s *Server) statsGroup(group string) ([]stat, bool) {
+	switch group {
+	case "":
+		return s.generalStats(), true
+	case "items":
+		return s.itemStats(), true
+	case "slabs":
+		return s.slabStats(), true
+	case "settings":
+		return s.settingsStats(), true
+	case "sizes":
+		return s.sizeStats(), true
+	case "conns":
+		return s.connStats(), true
+	case "replication":
+		return s.replicationStats(), true
+	}
+
+	return nil, false
+}
+
+func (s *Server) generalStats() []stat {
+	now := time.Now()
+	st := s.Store.Stats()
+
+	return []stat{
+		{"pid", os.Getpid()},
+		{"uptime", int64(now.Sub(s.startTime).Seconds())},
+		{"time", now.Unix()},
+		{"version", Version},
+		{"pointer_size", 64},
+		{"curr_connections", s.peerCount()},
+		{"total_connections", s.totalConns.Load()},
+		{"rejected_connections", s.rejectedConns.Load()},
+		{"cmd_get", st.CmdGet.Load()},
+		{"cmd_set", st.CmdSet.Load()},
+		{"cmd_flush", st.CmdFlush.Load()},
+		{"cmd_touch", st.CmdTouch.Load()},
+		{"get_hits", st.GetHits.Load()},
+		{"get_misses", st.GetMisses.Load()},
+		{"delete_misses", st.DeleteMiss.Load()},
+		{"delete_hits", st.DeleteHits.Load()},
+		{"incr_misses", st.IncrMisses.Load()},
+		{"incr_hits", st.IncrHits.Load()},
+		{"decr_misses", st.DecrMisses.Load()},
+		{"decr_hits", st.DecrHits.Load()},
+		{"cas_misses", st.CasMisses.Load()},
+		{"cas_hits", st.CasHits.Load()},
+		{"cas_badval", st.CasBadval.Load()},
+		{"touch_hits", st.TouchHits.Load()},
+		{"touch_misses", st.TouchMisses.Load()},
+		{"limit_maxbytes", s.Store.Config().MaxBytes},
+		{"bytes", s.Store.Bytes()},
+		{"curr_items", s.Store.Len()},
+		{"total_items", st.TotalItems.Load()},
+		{"evictions", st.Evictions.Load()},
+		{"crawler_starts", st.CrawlerStarts.Load()},
+		{"crawler_reclaimed", st.CrawlerReclaimed.Load()},
+	}
+}
+
+// itemStats reports the items of every slab class that holds items
+func (s *Server) itemStats() []stat {
+	now := time.Now().Unix()
+	number := make(map[int]int)
+	oldest := make(map[int]int64)
+
+	s.Store.Range(func(item *types.DataArgs) bool {
+		class := item.Class()
+		number[class]++
+
+		if t, ok := oldest[class]; !ok || item.Time < t {
+			oldest[class] = item.Time
+		}
+
+		return true
+	})
+
+	var stats []stat
+
+	for _, class := range s.slabClasses() {
+		if number[class.ID] == 0 {
+			continue
+		}
+
+		prefix := fmt.Sprintf("items:%d:", class.ID)
+
+		stats = append(stats,
+			stat{prefix + "number", number[class.ID]},
+			stat{prefix + "age", now - oldest[class.ID]},
+			stat{prefix + "evicted", class.Evictions},
+		)
+	}
+
+	return stats
+}
+
+// slabClasses returns the slab classes of the storage, storages without slabs have none
+func (s *Server) slabClasses() []types.SlabStats {
+	if slabs, ok := s.Store.(types.SlabStorage); ok {
+		return slabs.SlabStats()
+	}
+
+	return nil
+}
+
+// slabStats reports the pages and chunks of every slab class that has allocated pages
+func (s *Server) slabStats() []stat {
+	var stats []stat
+
+	active := 0
+	malloced := 0
+
+	for _, class := range s.slabClasses() {
+		if class.Pages == 0 {
+			continue
+		}
+
+		active++
+		malloced += class.Pages * class.PageSize
+
+		prefix := fmt.Sprintf("%d:", class.ID)
+
+		stats = append(stats,
+			stat{prefix + "chunk_size", class.ChunkSize},
+			stat{prefix + "chunks_per_page", class.ChunksPerPage},
+			stat{prefix + "total_pages", class.Pages},
+			stat{prefix + "total_chunks", class.Pages * class.ChunksPerPage},
+			stat{prefix + "used_chunks", class.Used},
+			stat{prefix + "free_chunks", class.Free},
+		)
+	}
+
+	return append(stats, stat{"active_slabs", active}, stat{"total_malloced", malloced})
+}
+
+func (s *Server) settingsStats() []stat {
+	_, port, _ := net.SplitHostPort(s.ListenAddr)
+	config := s.Store.Config()
+
+	return []stat{
+		{"maxbytes", config.MaxBytes},
+		{"growth_factor", config.Factor},
+		{"chunk_size", config.ChunkSize},
+		{"shards", config.Shards},
+		{"item_size_max", config.ItemSizeMax},
+		{"maxconns", s.MaxConns},
+		{"tcpport", port},
+		{"verbosity", s.verbosity.Load()},
+		{"evictions", evictionsSetting(config.EvictionPolicy)},
+		{"cas_enabled", "yes"},
+		{"flush_enabled", "yes"},
+	}
+}
+
+// evictionsSetting reports the eviction policy the way memcached reports -M
+func evictionsSetting(policy string) string {
+	if policy == types.EvictNone {
+		return "off"
+	}
+
+	return "on"
+}
+
+// sizeStats returns a histogram of the item sizes in buckets of 32 bytes
+func (s *Server) sizeStats() []stat {
+	sizes := make(map[int]int)
+
+	s.Store.Range(func(item *types.DataArgs) bool {
+		size := int(item.Size())
+		bucket := (size + sizeBucket - 1) / sizeBucket * sizeBucket
+
+		sizes[bucket]++
+
+		return true
+	})
+
+	buckets := make([]int, 0, len(sizes))
+
+	for bucket := range sizes {
+		buckets = append(buckets, bucket)
+	}
+
+	sort.Ints(buckets)
+
+	stats := make([]stat, 0, len(buckets))
+
+	for _, bucket := range buckets {
+		stats = append(stats, stat{fmt.Sprint(bucket), sizes[bucket]})
+	}
+
+	return stats
+}
+
+// connStats reports every client in the PeerMap
+func (s *Server) connStats() []stat {
+	s.peersMu.RLock()
+	defer s.peersMu.RUnlock()
+
+	peers := make([]*types.Peer, 0, len(s.PeerMap))
+
+	for _, peer := range s.PeerMap {
+		peers = append(peers, peer)
+	}
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].ConnectedAt.Before(peers[j].ConnectedAt)
+	})
+
+	now := time.Now()
+	stats := make([]stat, 0, len(peers)*3)
+
+	for _, peer := range peers {
+		stats = append(stats,
+			stat{peer.Name + ":addr", "tcp:" + peer.Conn.RemoteAddr().String()},
+			stat{peer.Name + ":connected", int64(now.Sub(peer.ConnectedAt).Seconds())},
+			stat{peer.Name + ":secs_since_last_cmd", int64(now.Sub(peer.LastCmdAt).Seconds())},
+		)
+	}
+
+	return stats
+}
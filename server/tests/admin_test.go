@@ -0,0 +1,123 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pschlafley/coding-challenges/go-memcache/server"
+	"github.com/pschlafley/coding-challenges/go-memcache/types"
+)
+
+func TestVersion(t *testing.T) {
+	_, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	expectResponse(t, conn, reader, "version\r\n", "VERSION "+server.Version+"\r\n")
+}
+
+func TestVerbosity(t *testing.T) {
+	_, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	expectResponse(t, conn, reader, "verbosity 0\r\n", "OK\r\n")
+
+	if stats := readStats(t, conn, reader, "stats settings"); stats["verbosity"] != "0" {
+		t.Fatalf("expected= verbosity 0, got= %s", stats["verbosity"])
+	}
+
+	expectResponse(t, conn, reader, "verbosity 2 noreply\r\nverbosity x\r\n", "CLIENT_ERROR bad command line format\r\n")
+}
+
+func TestLoggingDoesNotCopyTheValue(t *testing.T) {
+	s, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	value := strings.Repeat("v", 64*1024)
+	request := fmt.Sprintf("set big 0 0 %d\r\n%s\r\n", len(value), value)
+	set := func() { expectResponse(t, conn, reader, request, "STORED\r\n") }
+
+	// allocsPerSet returns the allocations and the allocated bytes of a set at the given verbosity
+	allocsPerSet := func(level int) (float64, uint64) {
+		s.SetVerbosity(level)
+		set()
+
+		var before, after runtime.MemStats
+
+		runtime.ReadMemStats(&before)
+		allocs := testing.AllocsPerRun(100, set)
+		runtime.ReadMemStats(&after)
+
+		// AllocsPerRun does a warm up run on top of the 100 runs
+		return allocs, (after.TotalAlloc - before.TotalAlloc) / 101
+	}
+
+	logged, loggedBytes := allocsPerSet(1)
+	quiet, quietBytes := allocsPerSet(0)
+
+	if quiet >= logged {
+		t.Fatalf("expected fewer allocations with logging off, got= %v with logging and %v without", logged, quiet)
+	}
+
+	// the request and the data block the server reads are allocated once each, a log message that holds
+	// the value would add another copy
+	for _, bytes := range []uint64{loggedBytes, quietBytes} {
+		if bytes >= uint64(3*len(value)) {
+			t.Fatalf("expected= less than %d bytes per set, got= %d", 3*len(value), bytes)
+		}
+	}
+}
+
+func TestLoggingOffLeavesTheLogFileAlone(t *testing.T) {
+	s := server.NewServer("127.0.0.1:0")
+	s.LogPath = filepath.Join(t.TempDir(), "server.log")
+
+	// a message that was queued before the logging got turned off
+	s.MsgCh <- types.Message{Text: "set a 0 1 bytes\n", TimeStamp: time.Now().Format(time.ANSIC)}
+	s.SetVerbosity(0)
+
+	s.HandleServerMessageQueue()
+
+	// the log goroutine goes through what is left in the queue before the shutdown returns
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(s.LogPath); !os.IsNotExist(err) {
+		t.Fatalf("expected: no log file with logging off, got: %v", err)
+	}
+}
+
+func TestQuit(t *testing.T) {
+	s, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte("quit\r\nget a\r\n"))
+
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Fatalf("expected= %v, got= %v", io.EOF, err)
+	}
+
+	other, err := net.Dial("tcp", s.Listener.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer other.Close()
+
+	otherReader := bufio.NewReader(other)
+
+	if stats := readStats(t, other, otherReader, "stats"); stats["curr_connections"] != "1" {
+		t.Fatalf("expected= curr_connections 1, got= %s", stats["curr_connections"])
+	}
+}
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pschlafley/coding-challenges/go-memcache/types"
+)
+
+// binaryPacket is a binary protocol request or response
+type binaryPacket struct {
+	opcode uint8
+	status uint16
+	opaque uint32
+	cas    uint64
+	extras []byte
+	key    []byte
+	value  []byte
+}
+
+func writeBinaryRequest(t *testing.T, conn net.Conn, p binaryPacket) {
+	header := make([]byte, 24)
+	header[0] = 0x80
+	header[1] = p.opcode
+	binary.BigEndian.PutUint16(header[2:], uint16(len(p.key)))
+	header[4] = uint8(len(p.extras))
+	binary.BigEndian.PutUint32(header[8:], uint32(len(p.extras)+len(p.key)+len(p.value)))
+	binary.BigEndian.PutUint32(header[12:], p.opaque)
+	binary.BigEndian.PutUint64(header[16:], p.cas)
+
+	packet := append(header, p.extras...)
+	packet = append(packet, p.key...)
+	packet = append(packet, p.value...)
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	if _, err := conn.Write(packet); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readBinaryResponse(t *testing.T, reader *bufio.Reader) binaryPacket {
+	header := make([]byte, 24)
+
+	if _, err := io.ReadFull(reader, header); err != nil {
+		t.Fatal(err)
+	}
+
+	if header[0] != 0x81 {
+		t.Fatalf("expected= magic 0x81, got= 0x%x", header[0])
+	}
+
+	body := make([]byte, binary.BigEndian.Uint32(header[8:]))
+
+	if _, err := io.ReadFull(reader, body); err != nil {
+		t.Fatal(err)
+	}
+
+	keyLen := int(binary.BigEndian.Uint16(header[2:]))
+	extrasLen := int(header[4])
+
+	return binaryPacket{
+		opcode: header[1],
+		status: binary.BigEndian.Uint16(header[6:]),
+		opaque: binary.BigEndian.Uint32(header[12:]),
+		cas:    binary.BigEndian.Uint64(header[16:]),
+		extras: body[:extrasLen],
+		key:    body[extrasLen : extrasLen+keyLen],
+		value:  body[extrasLen+keyLen:],
+	}
+}
+
+func TestBinarySetGet(t *testing.T) {
+	_, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	// flags 7, no expiration
+	setExtras := []byte{0, 0, 0, 7, 0, 0, 0, 0}
+
+	writeBinaryRequest(t, conn, binaryPacket{opcode: 0x01, opaque: 42, extras: setExtras, key: []byte("a"), value: []byte("hello")})
+	set := readBinaryResponse(t, reader)
+
+	if set.status != 0 || set.opaque != 42 || set.cas == 0 {
+		t.Fatalf("expected= status 0 opaque 42 and a cas, got= %+v", set)
+	}
+
+	writeBinaryRequest(t, conn, binaryPacket{opcode: 0x0c, key: []byte("a")})
+	get := readBinaryResponse(t, reader)
+
+	if get.status != 0 || string(get.value) != "hello" || string(get.key) != "a" || binary.BigEndian.Uint32(get.extras) != 7 || get.cas != set.cas {
+		t.Fatalf("expected= hello with flags 7, got= %+v", get)
+	}
+
+	// replacing with an outdated cas fails
+	writeBinaryRequest(t, conn, binaryPacket{opcode: 0x03, cas: set.cas + 1, extras: setExtras, key: []byte("a"), value: []byte("x")})
+
+	if res := readBinaryResponse(t, reader); res.status != 0x0002 {
+		t.Fatalf("expected= status 0x0002, got= 0x%x", res.status)
+	}
+
+	writeBinaryRequest(t, conn, binaryPacket{opcode: 0x04, key: []byte("a")})
+
+	if res := readBinaryResponse(t, reader); res.status != 0 {
+		t.Fatalf("expected= status 0, got= 0x%x", res.status)
+	}
+
+	writeBinaryRequest(t, conn, binaryPacket{opcode: 0x00, key: []byte("a")})
+
+	if res := readBinaryResponse(t, reader); res.status != 0x0001 {
+		t.Fatalf("expected= status 0x0001, got= 0x%x", res.status)
+	}
+}
+
+func TestBinaryValueLargerThanTheItemSizeLimit(t *testing.T) {
+	s, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	s.Store = types.NewStore(types.StoreConfig{MaxBytes: 1024 * 1024, Factor: 1.25, ChunkSize: 48, Shards: 1, ItemSizeMax: 1024})
+
+	writeBinaryRequest(t, conn, binaryPacket{opcode: 0x01, opaque: 7, extras: make([]byte, 8), key: []byte("a"), value: make([]byte, 2048)})
+
+	if res := readBinaryResponse(t, reader); res.status != 0x0003 || res.opaque != 7 {
+		t.Fatalf("expected= status 0x0003 for request 7, got= 0x%x for %d", res.status, res.opaque)
+	}
+
+	// the body has been skipped, so the connection is still in sync
+	writeBinaryRequest(t, conn, binaryPacket{opcode: 0x0a, opaque: 8})
+
+	if res := readBinaryResponse(t, reader); res.status != 0 || res.opaque != 8 {
+		t.Fatalf("expected= the noop to be answered, got= 0x%x for %d", res.status, res.opaque)
+	}
+
+	// a body of 4GB is answered right away instead of being allocated
+	header := make([]byte, 24)
+	header[0] = 0x80
+	header[1] = 0x01
+	binary.BigEndian.PutUint32(header[8:], 0xffffffff)
+	binary.BigEndian.PutUint32(header[12:], 9)
+
+	if _, err := conn.Write(header); err != nil {
+		t.Fatal(err)
+	}
+
+	if res := readBinaryResponse(t, reader); res.status != 0x0003 || res.opaque != 9 {
+		t.Fatalf("expected= status 0x0003 for request 9, got= 0x%x for %d", res.status, res.opaque)
+	}
+}
+
+func TestBinaryQuietAndNoop(t *testing.T) {
+	_, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	writeBinaryRequest(t, conn, binaryPacket{opcode: 0x11, extras: make([]byte, 8), key: []byte("a"), value: []byte("1")})
+	writeBinaryRequest(t, conn, binaryPacket{opcode: 0x09, key: []byte("missing")})
+	writeBinaryRequest(t, conn, binaryPacket{opcode: 0x09, key: []byte("a")})
+	writeBinaryRequest(t, conn, binaryPacket{opcode: 0x0a})
+
+	if res := readBinaryResponse(t, reader); res.opcode != 0x09 || string(res.value) != "1" {
+		t.Fatalf("expected= getq hit with value 1, got= %+v", res)
+	}
+
+	if res := readBinaryResponse(t, reader); res.opcode != 0x0a {
+		t.Fatalf("expected= noop, got= %+v", res)
+	}
+}
+
+func TestBinaryGetKMissReturnsTheKey(t *testing.T) {
+	_, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	for _, req := range []binaryPacket{
+		{opcode: 0x0c, key: []byte("missing")},
+		{opcode: 0x23, extras: make([]byte, 4), key: []byte("missing")},
+	} {
+		writeBinaryRequest(t, conn, req)
+
+		if res := readBinaryResponse(t, reader); res.status != 0x0001 || string(res.key) != "missing" || len(res.value) != 0 {
+			t.Fatalf("expected= status 0x0001 with the key missing, got= %+v", res)
+		}
+	}
+
+	// getkq stays quiet on a miss
+	writeBinaryRequest(t, conn, binaryPacket{opcode: 0x0d, key: []byte("missing")})
+	writeBinaryRequest(t, conn, binaryPacket{opcode: 0x0a})
+
+	if res := readBinaryResponse(t, reader); res.opcode != 0x0a {
+		t.Fatalf("expected= noop, got= %+v", res)
+	}
+
+	// a get without the key still answers with the error message
+	writeBinaryRequest(t, conn, binaryPacket{opcode: 0x00, key: []byte("missing")})
+
+	if res := readBinaryResponse(t, reader); res.status != 0x0001 || len(res.key) != 0 || string(res.value) != "Not found" {
+		t.Fatalf("expected= status 0x0001 with Not found, got= %+v", res)
+	}
+}
+
+func TestBinaryIncrAndSharedStore(t *testing.T) {
+	_, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	// delta 5, initial 10, expiration 0
+	extras := make([]byte, 20)
+	binary.BigEndian.PutUint64(extras, 5)
+	binary.BigEndian.PutUint64(extras[8:], 10)
+
+	writeBinaryRequest(t, conn, binaryPacket{opcode: 0x05, extras: extras, key: []byte("n")})
+
+	if res := readBinaryResponse(t, reader); binary.BigEndian.Uint64(res.value) != 10 {
+		t.Fatalf("expected= 10, got= %+v", res)
+	}
+
+	writeBinaryRequest(t, conn, binaryPacket{opcode: 0x05, extras: extras, key: []byte("n")})
+
+	if res := readBinaryResponse(t, reader); binary.BigEndian.Uint64(res.value) != 15 {
+		t.Fatalf("expected= 15, got= %+v", res)
+	}
+
+	// a text protocol client sees what the binary client stored
+	text, err := net.Dial("tcp", conn.RemoteAddr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer text.Close()
+
+	expectResponse(t, text, bufio.NewReader(text), "get n\r\n", "VALUE n 0 2\r\n15\r\nEND\r\n")
+}
+
+func TestBinaryVersionAndStat(t *testing.T) {
+	_, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	writeBinaryRequest(t, conn, binaryPacket{opcode: 0x0b})
+
+	if res := readBinaryResponse(t, reader); res.status != 0 || len(res.value) == 0 {
+		t.Fatalf("expected= a version, got= %+v", res)
+	}
+
+	writeBinaryRequest(t, conn, binaryPacket{opcode: 0x10})
+
+	stats := map[string]string{}
+
+	for {
+		res := readBinaryResponse(t, reader)
+
+		if len(res.key) == 0 {
+			break
+		}
+
+		stats[string(res.key)] = string(res.value)
+	}
+
+	if stats["curr_connections"] != "1" {
+		t.Fatalf("expected= curr_connections 1, got= %v", stats)
+	}
+}
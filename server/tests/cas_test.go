@@ -0,0 +1,53 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// getsCas fetches the key with gets and returns the cas unique from the VALUE line
+func getsCas(t *testing.T, reader *bufio.Reader, conn net.Conn, key string) string {
+	if _, err := conn.Write([]byte("gets " + key + "\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	fields := strings.Fields(readResponse(t, reader, 3))
+
+	if len(fields) < 5 || fields[0] != "VALUE" {
+		t.Fatalf("expected= VALUE line, got= %v", fields)
+	}
+
+	return fields[4]
+}
+
+func TestCas(t *testing.T) {
+	_, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	expectResponse(t, conn, reader, "cas counter 0 0 1 1\r\n1\r\n", "NOT_FOUND\r\n")
+	expectResponse(t, conn, reader, "set counter 0 0 1\r\n1\r\n", "STORED\r\n")
+
+	casUnique := getsCas(t, reader, conn, "counter")
+
+	expectResponse(t, conn, reader, "cas counter 0 0 1 "+casUnique+"\r\n2\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "cas counter 0 0 1 "+casUnique+"\r\n3\r\n", "EXISTS\r\n")
+	expectResponse(t, conn, reader, "get counter\r\n", "VALUE counter 0 1\r\n2\r\nEND\r\n")
+
+	if next := getsCas(t, reader, conn, "counter"); next == casUnique {
+		t.Fatalf("expected a new cas unique after the cas, got= %s", next)
+	}
+}
+
+func TestSetOverwritesAndAddDoesNot(t *testing.T) {
+	_, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	expectResponse(t, conn, reader, "set k 0 0 1\r\na\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "set k 0 0 1\r\nb\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "add k 0 0 1\r\nc\r\n", "NOT_STORED\r\n")
+	expectResponse(t, conn, reader, "get k\r\n", "VALUE k 0 1\r\nb\r\nEND\r\n")
+}
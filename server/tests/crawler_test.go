@@ -0,0 +1,62 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pschlafley/coding-challenges/go-memcache/types"
+)
+
+func TestCrawlExpiredInBatches(t *testing.T) {
+	store := newTestStore(1024*1024, 1.25)
+
+	for i := 0; i < 10; i++ {
+		item := &types.DataArgs{Key: fmt.Sprintf("key%d", i), DataBlock: []byte("value")}
+
+		// every other item has expired
+		if i%2 == 0 {
+			item.Exptime = -1
+		}
+
+		store.Set(item)
+	}
+
+	reclaimed := 0
+	batches := 0
+
+	for done := false; !done; batches++ {
+		var n int
+
+		n, done = store.CrawlExpired(3)
+		reclaimed += n
+	}
+
+	if reclaimed != 5 || store.Len() != 5 {
+		t.Fatalf("expected: 5 reclaimed and 5 left, got: %d reclaimed and %d left", reclaimed, store.Len())
+	}
+
+	if batches != 4 {
+		t.Fatalf("expected: the sweep to take 4 batches, got: %d", batches)
+	}
+}
+
+func TestCrawlerReclaimsUnreadItems(t *testing.T) {
+	s, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	s.RunCrawler(100 * time.Millisecond)
+
+	expectResponse(t, conn, reader, "set a 0 1 1\r\na\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "set b 0 1 1\r\nb\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "set c 0 0 1\r\nc\r\n", "STORED\r\n")
+
+	time.Sleep(2200 * time.Millisecond)
+
+	stats := readStats(t, conn, reader, "stats")
+
+	if stats["curr_items"] != "1" || stats["crawler_reclaimed"] != "2" {
+		t.Fatalf("expected= 1 item left and 2 reclaimed, got= %s items and %s reclaimed", stats["curr_items"], stats["crawler_reclaimed"])
+	}
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestUnknownCommand(t *testing.T) {
+	_, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	expectResponse(t, conn, reader, "bogus a b\r\n", "ERROR\r\n")
+	expectResponse(t, conn, reader, "\r\n", "ERROR\r\n")
+	expectResponse(t, conn, reader, "delete\r\n", "ERROR\r\n")
+	expectResponse(t, conn, reader, "get\r\n", "ERROR\r\n")
+}
+
+func TestMalformedStorageCommands(t *testing.T) {
+	_, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	expectResponse(t, conn, reader, "set a 0 0\r\n", "CLIENT_ERROR bad command line format\r\n")
+	expectResponse(t, conn, reader, "set a x 0 1\r\n1\r\n", "CLIENT_ERROR bad command line format\r\n")
+	expectResponse(t, conn, reader, "set a 0 x 1\r\n1\r\n", "CLIENT_ERROR bad command line format\r\n")
+	expectResponse(t, conn, reader, "set a 0 0 x\r\n", "CLIENT_ERROR bad command line format\r\n")
+	expectResponse(t, conn, reader, "set  a  0 0 1\r\n1\r\n", "STORED\r\n")
+}
+
+func TestLineTooLong(t *testing.T) {
+	_, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	expectResponse(t, conn, reader, "get "+strings.Repeat("k", 70000)+"\r\n", "CLIENT_ERROR line too long\r\n")
+	expectResponse(t, conn, reader, "get a\r\n", "END\r\n")
+}
+
+func TestDeleteNotFound(t *testing.T) {
+	_, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	expectResponse(t, conn, reader, "delete a\r\n", "NOT_FOUND\r\n")
+	expectResponse(t, conn, reader, "set a 0 0 1\r\n1\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "delete a\r\n", "DELETED\r\n")
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"bufio"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pschlafley/coding-challenges/go-memcache/server"
+)
+
+func TestFlushAll(t *testing.T) {
+	_, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	expectResponse(t, conn, reader, "set a 0 0 1\r\na\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "flush_all\r\n", "OK\r\n")
+	expectResponse(t, conn, reader, "get a\r\n", "END\r\n")
+	expectResponse(t, conn, reader, "set a 0 0 1\r\nb\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "get a\r\n", "VALUE a 0 1\r\nb\r\nEND\r\n")
+}
+
+func TestFlushAllDelayed(t *testing.T) {
+	_, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	expectResponse(t, conn, reader, "set a 0 0 1\r\na\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "flush_all 1 noreply\r\n", "")
+	expectResponse(t, conn, reader, "get a\r\n", "VALUE a 0 1\r\na\r\nEND\r\n")
+
+	time.Sleep(2100 * time.Millisecond)
+
+	expectResponse(t, conn, reader, "get a\r\n", "END\r\n")
+	expectResponse(t, conn, reader, "set b 0 0 1\r\nb\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "get b\r\n", "VALUE b 0 1\r\nb\r\nEND\r\n")
+}
+
+func TestFlushAllDelayedSurvivesRestart(t *testing.T) {
+	s, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "memcache.oplog")
+	s.SnapshotPath = filepath.Join(dir, "memcache.snapshot")
+
+	if _, _, err := s.OpenOpLog(path, server.FsyncAlways); err != nil {
+		t.Fatal(err)
+	}
+
+	// the item is stored after the flush_all, but before its point
+	expectResponse(t, conn, reader, "flush_all 2\r\n", "OK\r\n")
+	expectResponse(t, conn, reader, "set a 0 0 1\r\na\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "snapshot\r\n", "OK\r\n")
+
+	// opening the log compacts it, the pending flush has to be kept
+	compacted, compactedConn := startTestServer(t)
+
+	if _, _, err := compacted.OpenOpLog(path, server.FsyncAlways); err != nil {
+		t.Fatal(err)
+	}
+
+	expectResponse(t, compactedConn, bufio.NewReader(compactedConn), "get a\r\n", "VALUE a 0 1\r\na\r\nEND\r\n")
+
+	time.Sleep(2100 * time.Millisecond)
+
+	replayed, replayedConn := startTestServer(t)
+	replayedReader := bufio.NewReader(replayedConn)
+
+	if _, _, err := replayed.OpenOpLog(path, server.FsyncAlways); err != nil {
+		t.Fatal(err)
+	}
+
+	expectResponse(t, replayedConn, replayedReader, "get a\r\n", "END\r\n")
+	expectResponse(t, replayedConn, replayedReader, "set b 0 0 1\r\nb\r\n", "STORED\r\n")
+	expectResponse(t, replayedConn, replayedReader, "get b\r\n", "VALUE b 0 1\r\nb\r\nEND\r\n")
+
+	restored, restoredConn := startTestServer(t)
+	restored.SnapshotPath = s.SnapshotPath
+
+	if _, _, err := restored.Restore(); err != nil {
+		t.Fatal(err)
+	}
+
+	expectResponse(t, restoredConn, bufio.NewReader(restoredConn), "get a\r\n", "END\r\n")
+}
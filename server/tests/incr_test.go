@@ -0,0 +1,35 @@
+package server
+
+import (
+	"bufio"
+	"testing"
+)
+
+func TestIncrDecr(t *testing.T) {
+	_, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	expectResponse(t, conn, reader, "incr missing 1\r\n", "NOT_FOUND\r\n")
+	expectResponse(t, conn, reader, "set n 5 0 2\r\n10\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "incr n 5\r\n", "15\r\n")
+	expectResponse(t, conn, reader, "decr n 20\r\n", "0\r\n")
+	expectResponse(t, conn, reader, "incr n 7 noreply\r\n", "")
+	expectResponse(t, conn, reader, "get n\r\n", "VALUE n 5 1\r\n7\r\nEND\r\n")
+}
+
+func TestIncrWrapsOnOverflow(t *testing.T) {
+	_, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	expectResponse(t, conn, reader, "set n 0 0 20\r\n18446744073709551615\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "incr n 2\r\n", "1\r\n")
+}
+
+func TestIncrNonNumeric(t *testing.T) {
+	_, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	expectResponse(t, conn, reader, "set s 0 0 3\r\nabc\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "incr s 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+	expectResponse(t, conn, reader, "decr s abc\r\n", "CLIENT_ERROR invalid numeric delta argument\r\n")
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/pschlafley/coding-challenges/go-memcache/types"
+)
+
+func TestEvictLeastRecentlyUsed(t *testing.T) {
+	s, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	// a single page with room for exactly two items with a one byte key and value
+	s.Store = newPagedStore(288, 288, types.EvictLRU)
+
+	expectResponse(t, conn, reader, "set a 0 0 1\r\na\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "set b 0 0 1\r\nb\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "get a\r\n", "VALUE a 0 1\r\na\r\nEND\r\n")
+	expectResponse(t, conn, reader, "set c 0 0 1\r\nc\r\n", "STORED\r\n")
+
+	expectResponse(t, conn, reader, "get b\r\n", "END\r\n")
+	expectResponse(t, conn, reader, "get a c\r\n", "VALUE a 0 1\r\na\r\nVALUE c 0 1\r\nc\r\nEND\r\n")
+
+	stats := readStats(t, conn, reader, "stats")
+
+	if stats["evictions"] != "1" || stats["curr_items"] != "2" {
+		t.Fatalf("expected 1 eviction and 2 items, got: %v", stats)
+	}
+}
+
+func TestMovePageToAnotherClass(t *testing.T) {
+	s, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	// a single page that holds three small items
+	s.Store = newPagedStore(432, 432, types.EvictLRU)
+
+	expectResponse(t, conn, reader, "set a 0 0 1\r\na\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "set b 0 0 1\r\nb\r\n", "STORED\r\n")
+
+	// the class of the large value has no items to evict, so it takes the page of the small items
+	expectResponse(t, conn, reader, "set c 0 0 150\r\n"+strings.Repeat("c", 150)+"\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "get a b\r\n", "END\r\n")
+
+	if s.Store.Bytes() != 151+types.ItemOverhead {
+		t.Fatalf("expected: %d bytes, got: %d", 151+types.ItemOverhead, s.Store.Bytes())
+	}
+
+	stats := readStats(t, conn, reader, "stats slabs")
+
+	// classes without pages aren't listed
+	if _, listed := stats["1:total_pages"]; listed || stats["4:total_pages"] != "1" || stats["total_malloced"] != "296" {
+		t.Fatalf("expected: the page to have moved to class 4, got: %v", stats)
+	}
+
+	// the page of the class of this value is larger than the memory limit
+	expectResponse(t, conn, reader, "set c 0 0 400\r\n"+strings.Repeat("c", 400)+"\r\n", "SERVER_ERROR object too large for cache\r\n")
+	expectResponse(t, conn, reader, "get c\r\n", "END\r\n")
+
+	if s.Store.Bytes() != 0 {
+		t.Fatalf("expected: 0 bytes, got: %d", s.Store.Bytes())
+	}
+}
+
+func TestMemoryLimitCoversPages(t *testing.T) {
+	s, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	s.Store = newTestStore(1024*1024, 1.25)
+
+	// values of many sizes, far more than the limit in total
+	for i := 0; i < 400; i++ {
+		size := 1000 + i*97%60000
+
+		expectResponse(t, conn, reader, fmt.Sprintf("set k%d 0 0 %d\r\n%s\r\n", i, size, strings.Repeat("v", size)), "STORED\r\n")
+	}
+
+	stats := readStats(t, conn, reader, "stats slabs")
+	malloced, _ := strconv.Atoi(stats["total_malloced"])
+
+	if malloced == 0 || malloced > 1024*1024 {
+		t.Fatalf("expected: the pages to stay within the memory limit, got: %d", malloced)
+	}
+}
+
+func TestEvictionPolicyNone(t *testing.T) {
+	s, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	// a single page with room for two small items
+	s.Store = newPagedStore(288, 288, types.EvictNone)
+
+	expectResponse(t, conn, reader, "set a 0 0 1\r\na\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "set b 0 0 1\r\nb\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "set c 0 0 1\r\nc\r\n", "SERVER_ERROR out of memory storing object\r\n")
+
+	// a larger value for a stored key needs a page of another class and the old value stays
+	expectResponse(t, conn, reader, "set a 0 0 100\r\n"+strings.Repeat("a", 100)+"\r\n", "SERVER_ERROR out of memory storing object\r\n")
+	expectResponse(t, conn, reader, "get a b c\r\n", "VALUE a 0 1\r\na\r\nVALUE b 0 1\r\nb\r\nEND\r\n")
+
+	// overwriting with a value of the same class reuses the chunk of the old one
+	expectResponse(t, conn, reader, "set a 0 0 1\r\nx\r\n", "STORED\r\n")
+
+	stats := readStats(t, conn, reader, "stats")
+
+	if stats["evictions"] != "0" || stats["curr_items"] != "2" {
+		t.Fatalf("expected no evictions and 2 items, got: %v", stats)
+	}
+
+	if settings := readStats(t, conn, reader, "stats settings"); settings["evictions"] != "off" {
+		t.Fatalf("expected: evictions off, got: %s", settings["evictions"])
+	}
+}
+
+func TestEvictionPolicyNoneReclaimsExpiredItems(t *testing.T) {
+	s, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	s.Store = newPagedStore(288, 288, types.EvictNone)
+
+	// both items expire right away, but the crawler hasn't removed them
+	expectResponse(t, conn, reader, "set a 0 -1 1\r\na\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "set b 0 -1 1\r\nb\r\n", "STORED\r\n")
+
+	expectResponse(t, conn, reader, "set c 0 0 1\r\nc\r\n", "STORED\r\n")
+
+	// the page of the expired items is freed for a value of another class
+	expectResponse(t, conn, reader, "set d 0 -1 1\r\nd\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "delete c\r\n", "DELETED\r\n")
+	expectResponse(t, conn, reader, "set e 0 0 100\r\n"+strings.Repeat("e", 100)+"\r\n", "STORED\r\n")
+
+	stats := readStats(t, conn, reader, "stats")
+
+	if stats["evictions"] != "0" || stats["curr_items"] != "1" {
+		t.Fatalf("expected no evictions and 1 item, got: %v", stats)
+	}
+}
+
+func TestEvictionPolicyNoneKeepsTheOldValue(t *testing.T) {
+	// a single page with room for two items whose value is up to 7 bytes long
+	store := types.NewStore(types.StoreConfig{MaxBytes: 208, Factor: 1.25, ChunkSize: 8, Shards: 1, PageSize: 208, EvictionPolicy: types.EvictNone})
+
+	if err := store.Set(&types.DataArgs{Key: "a", DataBlock: []byte("a"), ByteCt: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Set(&types.DataArgs{Key: "n", DataBlock: []byte("9999999"), ByteCt: 7}); err != nil {
+		t.Fatal(err)
+	}
+
+	// both new values need a chunk of a larger class, which has no page
+	if _, err := store.Append("a", []byte("aaaaaaa")); err != types.ErrOutOfMemory {
+		t.Fatalf("expected: ErrOutOfMemory for the append, got: %v", err)
+	}
+
+	if _, err := store.Incr("n", 1); err != types.ErrOutOfMemory {
+		t.Fatalf("expected: ErrOutOfMemory for the incr, got: %v", err)
+	}
+
+	for key, value := range map[string]string{"a": "a", "n": "9999999"} {
+		if item, ok := store.Get(key); !ok || string(item.DataBlock) != value || item.ByteCt != len(value) {
+			t.Fatalf("expected: %s to keep %q, got: %+v", key, value, item)
+		}
+	}
+}
+
+func TestItemSizeMax(t *testing.T) {
+	s, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	s.Store = types.NewStore(types.StoreConfig{MaxBytes: 1024 * 1024, Factor: 1.25, ChunkSize: 48, Shards: 1, ItemSizeMax: 1024})
+
+	expectResponse(t, conn, reader, "set a 0 0 900\r\n"+strings.Repeat("a", 900)+"\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "set b 0 0 1024\r\n"+strings.Repeat("b", 1024)+"\r\n", "SERVER_ERROR object too large for cache\r\n")
+
+	if settings := readStats(t, conn, reader, "stats settings"); settings["item_size_max"] != "1024" {
+		t.Fatalf("expected: an item_size_max of 1024, got: %s", settings["item_size_max"])
+	}
+}
+
+func TestQueueRemoveAndMoveToBack(t *testing.T) {
+	q := types.NewQueue[int]()
+
+	one := q.Enque(1)
+	q.Enque(2)
+	three := q.Enque(3)
+
+	q.MoveToBack(one)
+	q.Remove(three)
+
+	got := []int{}
+
+	for node := q.Head(); node != nil; node = node.Next() {
+		got = append(got, node.Value())
+	}
+
+	if len(got) != 2 || got[0] != 2 || got[1] != 1 || q.Len() != 2 {
+		t.Fatalf("expected: [2 1], got: %v", got)
+	}
+}
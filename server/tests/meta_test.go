@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestMetaSetGet(t *testing.T) {
+	_, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	expectResponse(t, conn, reader, "mg a v\r\n", "EN\r\n")
+	expectResponse(t, conn, reader, "ms a 5 F7 T0 Oabc k\r\nhello\r\n", "HD Oabc ka\r\n")
+	expectResponse(t, conn, reader, "mg a v f s t\r\n", "VA 5 f7 s5 t-1\r\nhello\r\n")
+	expectResponse(t, conn, reader, "mg a\r\n", "HD\r\n")
+	expectResponse(t, conn, reader, "mg missing v q\r\nmn\r\n", "MN\r\n")
+}
+
+func TestMetaSetModesAndCas(t *testing.T) {
+	_, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	expectResponse(t, conn, reader, "ms a 1 ME\r\n1\r\n", "HD\r\n")
+	expectResponse(t, conn, reader, "ms a 1 ME\r\n2\r\n", "NS\r\n")
+	expectResponse(t, conn, reader, "ms a 1 MA\r\n3\r\n", "HD\r\n")
+	expectResponse(t, conn, reader, "ms a 1 MP\r\n0\r\n", "HD\r\n")
+	expectResponse(t, conn, reader, "ms b 1 MR\r\n0\r\n", "NS\r\n")
+	expectResponse(t, conn, reader, "mg a v\r\n", "VA 3\r\n013\r\n")
+	expectResponse(t, conn, reader, "ms a 1 C1\r\nx\r\n", "EX\r\n")
+	expectResponse(t, conn, reader, "ms b 1 C1\r\nx\r\n", "NF\r\n")
+}
+
+func TestMetaBase64Key(t *testing.T) {
+	_, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	// "Zm9v" is "foo"
+	expectResponse(t, conn, reader, "ms Zm9v 3 b\r\nbar\r\n", "HD\r\n")
+	expectResponse(t, conn, reader, "get foo\r\n", "VALUE foo 0 3\r\nbar\r\nEND\r\n")
+	expectResponse(t, conn, reader, "mg Zm9v b k v\r\n", "VA 3 kZm9v b\r\nbar\r\n")
+}
+
+func TestMetaDeleteAndInvalidate(t *testing.T) {
+	_, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	expectResponse(t, conn, reader, "md a\r\n", "NF\r\n")
+	expectResponse(t, conn, reader, "ms a 1\r\n1\r\n", "HD\r\n")
+	expectResponse(t, conn, reader, "md a I\r\n", "HD\r\n")
+	expectResponse(t, conn, reader, "mg a v\r\n", "VA 1 X W\r\n1\r\n")
+	expectResponse(t, conn, reader, "mg a v\r\n", "VA 1 X Z\r\n1\r\n")
+	expectResponse(t, conn, reader, "ms a 1\r\n2\r\n", "HD\r\n")
+	expectResponse(t, conn, reader, "mg a v\r\n", "VA 1\r\n2\r\n")
+	expectResponse(t, conn, reader, "md a q\r\nmn\r\n", "MN\r\n")
+	expectResponse(t, conn, reader, "mg a\r\n", "EN\r\n")
+}
+
+func TestMetaAutovivify(t *testing.T) {
+	_, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	expectResponse(t, conn, reader, "mg a N30 v\r\n", "VA 0 W\r\n\r\n")
+	expectResponse(t, conn, reader, "mg a N30 v\r\n", "VA 0 Z\r\n\r\n")
+}
+
+func TestMetaArithmetic(t *testing.T) {
+	_, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	expectResponse(t, conn, reader, "ma n\r\n", "NF\r\n")
+	expectResponse(t, conn, reader, "ma n N0 J10 v\r\n", "VA 2\r\n10\r\n")
+	expectResponse(t, conn, reader, "ma n D5 v\r\n", "VA 2\r\n15\r\n")
+	expectResponse(t, conn, reader, "ma n MD D20 v\r\n", "VA 1\r\n0\r\n")
+	expectResponse(t, conn, reader, "ma n\r\n", "HD\r\n")
+	expectResponse(t, conn, reader, "get n\r\n", "VALUE n 0 1\r\n1\r\nEND\r\n")
+}
+
+func TestMetaDebug(t *testing.T) {
+	_, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	expectResponse(t, conn, reader, "me a\r\n", "EN\r\n")
+	expectResponse(t, conn, reader, "ms a 1\r\n1\r\n", "HD\r\n")
+
+	if _, err := conn.Write([]byte("me a\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	line := readResponse(t, reader, 1)
+
+	if !strings.HasPrefix(line, "ME a exp=-1 la=") {
+		t.Fatalf("expected= ME a exp=-1 ..., got= %q", line)
+	}
+}
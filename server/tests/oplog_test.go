@@ -0,0 +1,215 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pschlafley/coding-challenges/go-memcache/server"
+	"github.com/pschlafley/coding-challenges/go-memcache/types"
+)
+
+func TestOpLogReplaysMutations(t *testing.T) {
+	s, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	path := filepath.Join(t.TempDir(), "memcache.oplog")
+
+	if _, _, err := s.OpenOpLog(path, server.FsyncAlways); err != nil {
+		t.Fatal(err)
+	}
+
+	expectResponse(t, conn, reader, "set a 5 0 5\r\nhello\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "append a 0 0 6\r\n world\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "set n 0 0 1\r\n1\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "incr n 41\r\n", "42\r\n")
+	expectResponse(t, conn, reader, "set gone 0 0 1\r\ng\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "delete gone\r\n", "DELETED\r\n")
+	expectResponse(t, conn, reader, "set short 0 100 1\r\ns\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "touch short 1\r\n", "TOUCHED\r\n")
+	// a failed mutation doesn't change anything and isn't replayed as one
+	expectResponse(t, conn, reader, "add a 0 0 1\r\nx\r\n", "NOT_STORED\r\n")
+
+	cas := getsCas(t, reader, conn, "a")
+
+	time.Sleep(2100 * time.Millisecond)
+
+	replayed, replayedConn := startTestServer(t)
+	replayedReader := bufio.NewReader(replayedConn)
+
+	if _, _, err := replayed.OpenOpLog(path, server.FsyncAlways); err != nil {
+		t.Fatal(err)
+	}
+
+	expectResponse(t, replayedConn, replayedReader, "get a n gone short\r\n", "VALUE a 5 11\r\nhello world\r\nVALUE n 0 2\r\n42\r\nEND\r\n")
+
+	if replayedCas := getsCas(t, replayedReader, replayedConn, "a"); replayedCas != cas {
+		t.Fatalf("expected: cas %s, got: %s", cas, replayedCas)
+	}
+
+	// a flush is replayed as well
+	expectResponse(t, replayedConn, replayedReader, "flush_all\r\n", "OK\r\n")
+
+	flushed, flushedConn := startTestServer(t)
+	flushedReader := bufio.NewReader(flushedConn)
+
+	if _, _, err := flushed.OpenOpLog(path, server.FsyncAlways); err != nil {
+		t.Fatal(err)
+	}
+
+	expectResponse(t, flushedConn, flushedReader, "get a n\r\n", "END\r\n")
+}
+
+func TestOpLogReplaysMetaState(t *testing.T) {
+	s, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	path := filepath.Join(t.TempDir(), "memcache.oplog")
+
+	if _, _, err := s.OpenOpLog(path, server.FsyncAlways); err != nil {
+		t.Fatal(err)
+	}
+
+	expectResponse(t, conn, reader, "ms a 1\r\n1\r\n", "HD\r\n")
+	expectResponse(t, conn, reader, "md a I\r\n", "HD\r\n")
+	expectResponse(t, conn, reader, "mg a v\r\n", "VA 1 X W\r\n1\r\n")
+
+	replayed, replayedConn := startTestServer(t)
+	replayedReader := bufio.NewReader(replayedConn)
+
+	if _, _, err := replayed.OpenOpLog(path, server.FsyncAlways); err != nil {
+		t.Fatal(err)
+	}
+
+	// the client that got the W flag is still the one that refills the item
+	expectResponse(t, replayedConn, replayedReader, "mg a v\r\n", "VA 1 X Z\r\n1\r\n")
+}
+
+func TestOpLogSkipsItemsThatDontFit(t *testing.T) {
+	s, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	path := filepath.Join(t.TempDir(), "memcache.oplog")
+
+	if _, _, err := s.OpenOpLog(path, server.FsyncAlways); err != nil {
+		t.Fatal(err)
+	}
+
+	expectResponse(t, conn, reader, "set a 0 0 1\r\na\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "set b 0 0 1\r\nb\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "set c 0 0 1\r\nc\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "set large 0 0 400\r\n"+strings.Repeat("l", 400)+"\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "set a 0 0 100\r\n"+strings.Repeat("a", 100)+"\r\n", "STORED\r\n")
+
+	replayed, replayedConn := startTestServer(t)
+	replayedReader := bufio.NewReader(replayedConn)
+
+	// a single page with room for two small items, the large one is too large for the memory limit
+	replayed.Store = newPagedStore(288, 288, types.EvictNone)
+
+	records, skipped, err := replayed.OpenOpLog(path, server.FsyncAlways)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if records != 5 || skipped != 3 {
+		t.Fatalf("expected: 5 records and 3 skipped items, got: %d records, %d skipped", records, skipped)
+	}
+
+	// the new value of a doesn't fit, so its old one is gone as well
+	expectResponse(t, replayedConn, replayedReader, "get a b c large\r\n", "VALUE b 0 1\r\nb\r\nEND\r\n")
+}
+
+func TestOpLogIgnoresIncompleteRecord(t *testing.T) {
+	s, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	path := filepath.Join(t.TempDir(), "memcache.oplog")
+
+	if _, _, err := s.OpenOpLog(path, server.FsyncAlways); err != nil {
+		t.Fatal(err)
+	}
+
+	expectResponse(t, conn, reader, "set a 0 0 1\r\na\r\n", "STORED\r\n")
+
+	// a crash in the middle of a write leaves the start of a record behind
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file.Write([]byte{0, 0, 0, 40, 1, 2})
+	file.Close()
+
+	replayed, replayedConn := startTestServer(t)
+	replayedReader := bufio.NewReader(replayedConn)
+
+	if _, _, err := replayed.OpenOpLog(path, server.FsyncAlways); err != nil {
+		t.Fatal(err)
+	}
+
+	expectResponse(t, replayedConn, replayedReader, "get a\r\n", "VALUE a 0 1\r\na\r\nEND\r\n")
+
+	if _, _, err := replayed.OpenOpLog(path, "sometimes"); err == nil {
+		t.Fatal("expected: an error for an unknown fsync policy")
+	}
+}
+
+func TestOpLogCompaction(t *testing.T) {
+	s, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	path := filepath.Join(t.TempDir(), "memcache.oplog")
+
+	if _, _, err := s.OpenOpLog(path, server.FsyncNever); err != nil {
+		t.Fatal(err)
+	}
+
+	value := strings.Repeat("v", 100*1024)
+
+	for i := 0; i < 25; i++ {
+		expectResponse(t, conn, reader, fmt.Sprintf("set big 0 0 %d\r\n%s\r\n", len(value), value), "STORED\r\n")
+	}
+
+	// the log holds 25 versions of the key until it is rewritten from the single item in the store
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		info, err := os.Stat(path)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info.Size() < 2*int64(len(value)) {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected: the log to be compacted, it is %d bytes", info.Size())
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	expectResponse(t, conn, reader, "set small 0 0 1\r\ns\r\n", "STORED\r\n")
+
+	replayed, replayedConn := startTestServer(t)
+	replayedReader := bufio.NewReader(replayedConn)
+
+	if _, _, err := replayed.OpenOpLog(path, server.FsyncNever); err != nil {
+		t.Fatal(err)
+	}
+
+	expectResponse(t, replayedConn, replayedReader, "get small\r\n", "VALUE small 0 1\r\ns\r\nEND\r\n")
+
+	if got := readStats(t, replayedConn, replayedReader, "stats")["curr_items"]; got != "2" {
+		t.Fatalf("expected: 2 items, got: %s", got)
+	}
+}
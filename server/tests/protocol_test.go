@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pschlafley/coding-challenges/go-memcache/types"
+)
+
+func TestPipelinedCommands(t *testing.T) {
+	_, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	expectResponse(t, conn, reader, "set a 0 0 5\r\nhello\r\nset b 0 0 5\r\nworld\r\n", "STORED\r\nSTORED\r\n")
+}
+
+func TestLargeDataBlock(t *testing.T) {
+	_, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	value := strings.Repeat("x", 10000)
+
+	expectResponse(t, conn, reader, "set big 0 0 10000\r\n"+value+"\r\n", "STORED\r\n")
+}
+
+func TestDataBlockSplitAcrossWrites(t *testing.T) {
+	_, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	conn.Write([]byte("set split 0 0 10\r\nhello"))
+	time.Sleep(50 * time.Millisecond)
+
+	expectResponse(t, conn, reader, "world\r\n", "STORED\r\n")
+}
+
+func TestBadDataChunk(t *testing.T) {
+	_, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	expectResponse(t, conn, reader, "set a 0 0 3\r\nhello\r\n", "CLIENT_ERROR bad data chunk\r\n")
+	expectResponse(t, conn, reader, "set a 0 0 5\r\nhello\r\n", "STORED\r\n")
+}
+
+func TestDataBlockLargerThanTheItemSizeLimit(t *testing.T) {
+	s, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	s.Store = types.NewStore(types.StoreConfig{MaxBytes: 1024 * 1024, Factor: 1.25, ChunkSize: 48, Shards: 1, ItemSizeMax: 1024})
+
+	// the data block is thrown away, so the command after it is still parsed
+	expectResponse(t, conn, reader, "set a 0 0 2048\r\n"+strings.Repeat("a", 2048)+"\r\nset b 0 0 1\r\nb\r\n",
+		"SERVER_ERROR object too large for cache\r\n")
+
+	if got := readResponse(t, reader, 1); got != "STORED\r\n" {
+		t.Fatalf("expected: the next command to be stored, got: %q", got)
+	}
+
+	expectResponse(t, conn, reader, "ms m 2048 T0\r\n"+strings.Repeat("m", 2048)+"\r\n", "SERVER_ERROR object too large for cache\r\n")
+
+	// a byte count no one can send doesn't make the server allocate it, the server waits for the data
+	if _, err := conn.Write([]byte("set huge 0 0 9223372036854775807\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := net.Dial("tcp", s.Listener.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer other.Close()
+
+	expectResponse(t, other, bufio.NewReader(other), "get b\r\n", "VALUE b 0 1\r\nb\r\nEND\r\n")
+}
+
+func TestBinarySafeValues(t *testing.T) {
+	_, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	value := "  a\r\nb\x00\xff  "
+
+	expectResponse(t, conn, reader, "set bin 0 0 10\r\n"+value+"\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "get bin\r\n", "VALUE bin 0 10\r\n"+value+"\r\nEND\r\n")
+}
+
+func TestAppendPrependKeepWhitespace(t *testing.T) {
+	_, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	expectResponse(t, conn, reader, "set ws 0 0 3\r\n b \r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "append ws 0 0 2\r\nc \r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "prepend ws 0 0 2\r\n a\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "get ws\r\n", "VALUE ws 0 7\r\n a b c \r\nEND\r\n")
+}
+
+func TestMultiGet(t *testing.T) {
+	_, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	expectResponse(t, conn, reader, "set a 0 0 1\r\n1\r\nset c 0 0 1\r\n3\r\n", "STORED\r\nSTORED\r\n")
+	expectResponse(t, conn, reader, "get c b a\r\n", "VALUE c 0 1\r\n3\r\nVALUE a 0 1\r\n1\r\nEND\r\n")
+	expectResponse(t, conn, reader, "get b\r\n", "END\r\n")
+}
+
+func TestKeyTooLong(t *testing.T) {
+	_, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	key := strings.Repeat("k", 251)
+
+	expectResponse(t, conn, reader, "get a "+key+"\r\n", "CLIENT_ERROR bad command line format\r\n")
+	expectResponse(t, conn, reader, "set "+key+" 0 0 1\r\n1\r\n", "CLIENT_ERROR bad command line format\r\n")
+	expectResponse(t, conn, reader, "set "+key[1:]+" 0 0 1\r\n1\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "get "+key[1:]+"\r\n", "VALUE "+key[1:]+" 0 1\r\n1\r\nEND\r\n")
+}
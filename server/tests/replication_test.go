@@ -0,0 +1,220 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pschlafley/coding-challenges/go-memcache/server"
+	"github.com/pschlafley/coding-challenges/go-memcache/types"
+)
+
+// waitFor polls the condition until it holds or the deadline passes
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// getValue returns the response of a get for the key
+func getValue(t *testing.T, conn net.Conn, reader *bufio.Reader, key string) string {
+	t.Helper()
+
+	if _, err := conn.Write([]byte("get " + key + "\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	line := readResponse(t, reader, 1)
+
+	if line == "END\r\n" {
+		return line
+	}
+
+	return line + readResponse(t, reader, 2)
+}
+
+// linkProxy forwards connections to the target and can cut all of them at once
+type linkProxy struct {
+	ln     net.Listener
+	target string
+	mu     sync.Mutex
+	conns  []net.Conn
+}
+
+func startLinkProxy(t *testing.T, target string) *linkProxy {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &linkProxy{ln: ln, target: target}
+
+	t.Cleanup(func() {
+		ln.Close()
+		p.cut()
+	})
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+
+			if err != nil {
+				return
+			}
+
+			upstream, err := net.Dial("tcp", target)
+
+			if err != nil {
+				conn.Close()
+				continue
+			}
+
+			p.mu.Lock()
+			p.conns = append(p.conns, conn, upstream)
+			p.mu.Unlock()
+
+			go io.Copy(upstream, conn)
+			go io.Copy(conn, upstream)
+		}
+	}()
+
+	return p
+}
+
+func (p *linkProxy) cut() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+
+	p.conns = nil
+}
+
+func TestReplicaSyncsAndStreams(t *testing.T) {
+	primary, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	primary.EnableReplication(server.DefaultReplBacklogSize)
+
+	expectResponse(t, conn, reader, "set before 3 0 5\r\nhello\r\n", "STORED\r\n")
+
+	replica, replicaConn := startTestServer(t)
+	replicaReader := bufio.NewReader(replicaConn)
+
+	replica.ReplicaOf(primary.Listener.Addr().String())
+
+	waitFor(t, "the full sync", func() bool {
+		return getValue(t, replicaConn, replicaReader, "before") == "VALUE before 3 5\r\nhello\r\nEND\r\n"
+	})
+
+	expectResponse(t, conn, reader, "set after 0 0 5\r\nworld\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "incr after 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+	expectResponse(t, conn, reader, "delete before\r\n", "DELETED\r\n")
+
+	waitFor(t, "the streamed mutations", func() bool {
+		return getValue(t, replicaConn, replicaReader, "before") == "END\r\n" &&
+			getValue(t, replicaConn, replicaReader, "after") == "VALUE after 0 5\r\nworld\r\nEND\r\n"
+	})
+
+	// the cas uniques of the primary are kept, so a client can switch over with them
+	if primaryCas, replicaCas := getsCas(t, reader, conn, "after"), getsCas(t, replicaReader, replicaConn, "after"); primaryCas != replicaCas {
+		t.Fatalf("expected: cas %s on the replica, got: %s", primaryCas, replicaCas)
+	}
+
+	expectResponse(t, replicaConn, replicaReader, "set after 0 0 1\r\nx\r\n", "SERVER_ERROR replica is read-only\r\n")
+	expectResponse(t, replicaConn, replicaReader, "flush_all\r\n", "SERVER_ERROR replica is read-only\r\n")
+
+	stats := readStats(t, replicaConn, replicaReader, "stats replication")
+
+	if stats["role"] != "replica" || stats["primary_link_status"] != "up" || stats["full_syncs"] != "1" {
+		t.Fatalf("expected: a connected replica after one full sync, got: %v", stats)
+	}
+
+	waitFor(t, "the replica to acknowledge the primary's offset", func() bool {
+		stats := readStats(t, conn, reader, "stats replication")
+		return stats["connected_replicas"] == "1" && stats["replica0:lag_bytes"] == "0"
+	})
+}
+
+func TestReplicaSkipsItemsThatDontFit(t *testing.T) {
+	primary, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	primary.EnableReplication(server.DefaultReplBacklogSize)
+
+	expectResponse(t, conn, reader, "set large 0 0 400\r\n"+strings.Repeat("l", 400)+"\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "set before 0 0 1\r\nb\r\n", "STORED\r\n")
+
+	replica, replicaConn := startTestServer(t)
+	replicaReader := bufio.NewReader(replicaConn)
+
+	// the page of the class of the large values is larger than the memory limit of the replica
+	replica.Store = newPagedStore(288, 288, types.EvictLRU)
+	replica.ReplicaOf(primary.Listener.Addr().String())
+
+	waitFor(t, "the full sync", func() bool {
+		return getValue(t, replicaConn, replicaReader, "before") == "VALUE before 0 1\r\nb\r\nEND\r\n"
+	})
+
+	expectResponse(t, conn, reader, "set large 0 0 500\r\n"+strings.Repeat("l", 500)+"\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "set after 0 0 1\r\na\r\n", "STORED\r\n")
+
+	waitFor(t, "the streamed mutations", func() bool {
+		return getValue(t, replicaConn, replicaReader, "after") == "VALUE after 0 1\r\na\r\nEND\r\n"
+	})
+
+	stats := readStats(t, replicaConn, replicaReader, "stats replication")
+
+	if stats["full_syncs"] != "1" || stats["skipped_items"] != "2" {
+		t.Fatalf("expected: one full sync and 2 skipped items, got: %v", stats)
+	}
+}
+
+func TestReplicaResumesFromOffset(t *testing.T) {
+	primary, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	primary.EnableReplication(server.DefaultReplBacklogSize)
+
+	proxy := startLinkProxy(t, primary.Listener.Addr().String())
+
+	replica, replicaConn := startTestServer(t)
+	replicaReader := bufio.NewReader(replicaConn)
+
+	replica.ReplicaOf(proxy.ln.Addr().String())
+
+	expectResponse(t, conn, reader, "set a 0 0 1\r\n1\r\n", "STORED\r\n")
+
+	waitFor(t, "the first mutation", func() bool {
+		return getValue(t, replicaConn, replicaReader, "a") == "VALUE a 0 1\r\n1\r\nEND\r\n"
+	})
+
+	proxy.cut()
+
+	expectResponse(t, conn, reader, "set b 0 0 1\r\n2\r\n", "STORED\r\n")
+
+	waitFor(t, "the mutation made while the replica was disconnected", func() bool {
+		return getValue(t, replicaConn, replicaReader, "b") == "VALUE b 0 1\r\n2\r\nEND\r\n"
+	})
+
+	stats := readStats(t, replicaConn, replicaReader, "stats replication")
+
+	if stats["full_syncs"] != "1" || stats["partial_syncs"] != "1" {
+		t.Fatalf("expected: the replica to resume without a second full sync, got: %v", stats)
+	}
+}
@@ -3,10 +3,13 @@ package server
 import (
 	"bufio"
 	"fmt"
+	"net"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/pschlafley/coding-challenges/go-memcache/server"
 	"github.com/pschlafley/coding-challenges/go-memcache/types"
 )
 
@@ -28,28 +31,28 @@ var (
 	dataArgsMap = map[string]types.DataArgs{
 		"casey": {
 			Key:       "casey",
-			DataBlock: "VALUE 0 5 casey",
+			DataBlock: []byte("VALUE 0 5 casey"),
 			Exptime:   0,
 			ByteCt:    5,
 			Noreply:   false,
 		},
 		"peyton": {
 			Key:       "peyton",
-			DataBlock: "VALUE 0 6 peyton",
+			DataBlock: []byte("VALUE 0 6 peyton"),
 			Exptime:   0,
 			ByteCt:    6,
 			Noreply:   false,
 		},
 		"andre": {
 			Key:       "andre",
-			DataBlock: "VALUE 0 5 andre",
+			DataBlock: []byte("VALUE 0 5 andre"),
 			Exptime:   0,
 			ByteCt:    5,
 			Noreply:   false,
 		},
 		"jerika": {
 			Key:       "jerika",
-			DataBlock: "VALUE 0 6 andre",
+			DataBlock: []byte("VALUE 0 6 andre"),
 			Exptime:   0,
 			ByteCt:    6,
 			Noreply:   false,
@@ -62,10 +65,10 @@ func dataParser(cmd *types.ServerCmd, data []byte) *types.ServerCmd {
 
 	switch dataSlice[0] != "" {
 	case dataSlice[0] != "set" && dataSlice[0] != "get" && dataSlice[0] != "add" && dataSlice[0] != "replace" && dataSlice[0] != "delete":
-		cmd.DataBlock = string(data)
+		cmd.DataBlock = data
 	case dataSlice[0] == "set":
 		cmd.Command = string(data)
-		cmd.DataBlock = ""
+		cmd.DataBlock = nil
 	case dataSlice[0] == "get":
 		cmd.Command = string(data)
 	case dataSlice[0] == "add":
@@ -248,3 +251,131 @@ func handleRemoveLogs(file *os.File) error {
 
 	return nil
 }
+
+// startTestServer starts a server on an ephemeral port and returns a connection to it, the messages
+// sent to the log queue are drained so that the tests do not write to the log file
+func startTestServer(t *testing.T) (*server.Server, net.Conn) {
+	s := server.NewServer("127.0.0.1:0")
+
+	ln, err := net.Listen("tcp", s.ListenAddr)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Listener = ln
+
+	go func() {
+		for range s.MsgCh {
+		}
+	}()
+
+	go s.AcceptConnections()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	return s, conn
+}
+
+// readResponse reads n lines off of the connection
+func readResponse(t *testing.T, reader *bufio.Reader, n int) string {
+	var sb strings.Builder
+
+	for i := 0; i < n; i++ {
+		line, err := reader.ReadString('\n')
+
+		if err != nil {
+			t.Fatalf("expected %d lines, got= %q, error: %s", n, sb.String(), err)
+		}
+
+		sb.WriteString(line)
+	}
+
+	return sb.String()
+}
+
+// newTestStore creates a store with a single shard, so that the whole memory limit is available to every key
+func newTestStore(maxBytes int64, factor float64) *types.Store {
+	return types.NewStore(types.StoreConfig{MaxBytes: maxBytes, Factor: factor, ChunkSize: 48, Shards: 1})
+}
+
+// newPagedStore creates a store with a single shard whose slab classes use pages of the given size, so the
+// tests can fill the memory limit with a few items
+func newPagedStore(maxBytes int64, pageSize int, policy string) *types.Store {
+	return types.NewStore(types.StoreConfig{MaxBytes: maxBytes, Factor: 1.25, ChunkSize: 48, Shards: 1, PageSize: pageSize, EvictionPolicy: policy})
+}
+
+func expectResponse(t *testing.T, conn net.Conn, reader *bufio.Reader, request string, expected string) {
+	t.Helper()
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+
+	got := readResponse(t, reader, strings.Count(expected, "\n"))
+
+	if got != expected {
+		t.Fatalf("expected= %q, got= %q", expected, got)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	s := server.NewServer("127.0.0.1:0")
+	s.MaxConns = 1
+
+	ln, err := net.Listen("tcp", s.ListenAddr)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Listener = ln
+
+	go func() {
+		for range s.MsgCh {
+		}
+	}()
+
+	go s.AcceptConnections()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+
+	// the first connection is served, so the server has seen it before the second one comes in
+	expectResponse(t, conn, reader, "version\r\n", "VERSION "+server.Version+"\r\n")
+
+	rejected, err := net.Dial("tcp", ln.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rejected.Close()
+
+	rejected.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	if got := readResponse(t, bufio.NewReader(rejected), 1); got != "ERROR Too many open connections\r\n" {
+		t.Fatalf("expected: the connection to be turned away, got: %q", got)
+	}
+
+	stats := readStats(t, conn, reader, "stats")
+
+	if stats["rejected_connections"] != "1" || stats["curr_connections"] != "1" {
+		t.Fatalf("expected: 1 rejected and 1 current connection, got: %v", stats)
+	}
+}
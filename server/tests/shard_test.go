@@ -0,0 +1,114 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/pschlafley/coding-challenges/go-memcache/types"
+)
+
+func TestConcurrentClients(t *testing.T) {
+	s, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	expectResponse(t, conn, reader, "set counter 0 0 1\r\n0\r\n", "STORED\r\n")
+
+	const clients = 8
+	const rounds = 100
+
+	var wg sync.WaitGroup
+
+	for c := 0; c < clients; c++ {
+		wg.Add(1)
+
+		go func(c int) {
+			defer wg.Done()
+
+			clientConn, err := net.Dial("tcp", s.Listener.Addr().String())
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			defer clientConn.Close()
+
+			clientReader := bufio.NewReader(clientConn)
+
+			for i := 0; i < rounds; i++ {
+				key := fmt.Sprintf("key%d_%d", c, i)
+
+				fmt.Fprintf(clientConn, "set %s 0 0 1\r\nv\r\nincr counter 1\r\nget %s counter\r\nstats\r\n", key, key)
+
+				// STORED, the counter, the get response and the stats until their END
+				for ends := 0; ends < 2; {
+					line, err := clientReader.ReadString('\n')
+
+					if err != nil {
+						t.Error(err)
+						return
+					}
+
+					if line == "END\r\n" {
+						ends++
+					}
+				}
+			}
+		}(c)
+	}
+
+	wg.Wait()
+
+	expectResponse(t, conn, reader, "get counter\r\n", fmt.Sprintf("VALUE counter 0 3\r\n%d\r\nEND\r\n", clients*rounds))
+
+	if stats := readStats(t, conn, reader, "stats"); stats["curr_items"] != fmt.Sprint(clients*rounds+1) {
+		t.Fatalf("expected= curr_items %d, got= %s", clients*rounds+1, stats["curr_items"])
+	}
+}
+
+func TestKeysAreSpreadOverShards(t *testing.T) {
+	store := types.NewStore(types.StoreConfig{MaxBytes: 1024 * 1024 * 16, Factor: 1.25, ChunkSize: 48, Shards: 4})
+
+	// a single command may lock the same shard for several of its keys
+	unlock := store.LockKeys(true, "a", "b", "c", "d", "a", "e")
+
+	for i := 0; i < 5; i++ {
+		key := string(rune('a' + i))
+
+		if err := store.Set(&types.DataArgs{Key: key, DataBlock: []byte(key)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	unlock()
+
+	if store.Shards() != 4 || store.Len() != 5 {
+		t.Fatalf("expected: 5 items in 4 shards, got: %d items in %d shards", store.Len(), store.Shards())
+	}
+
+	defer store.LockAll(true)()
+
+	for i := 0; i < 5; i++ {
+		key := string(rune('a' + i))
+
+		if item, ok := store.Get(key); !ok || string(item.DataBlock) != key {
+			t.Fatalf("expected: %s to be stored, got: %v", key, item)
+		}
+	}
+}
+
+func TestShardsGetAShareOfTheMemoryLimit(t *testing.T) {
+	// every shard gets 64KB
+	store := types.NewStore(types.StoreConfig{MaxBytes: 1024 * 1024, Factor: 1.25, ChunkSize: 48, Shards: 16})
+
+	if err := store.Set(&types.DataArgs{Key: "small", DataBlock: make([]byte, 30*1024)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Set(&types.DataArgs{Key: "large", DataBlock: make([]byte, 100*1024)}); err != types.ErrTooLarge {
+		t.Fatalf("expected: an item larger than the share of its shard to be rejected, got: %v", err)
+	}
+}
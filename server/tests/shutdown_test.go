@@ -0,0 +1,165 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pschlafley/coding-challenges/go-memcache/server"
+)
+
+func TestShutdownClosesIdleConnections(t *testing.T) {
+	s, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	expectResponse(t, conn, reader, "set a 0 0 1\r\na\r\n", "STORED\r\n")
+
+	addr := s.Listener.Addr().String()
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	if _, err := reader.ReadByte(); err == nil {
+		t.Fatal("expected: the idle connection to be closed")
+	}
+
+	if newConn, err := net.Dial("tcp", addr); err == nil {
+		newConn.Close()
+		t.Fatal("expected: the listener to be closed")
+	}
+
+	if err := s.Shutdown(context.Background()); err != server.ErrServerClosed {
+		t.Fatalf("expected: ErrServerClosed for a second shutdown, got: %v", err)
+	}
+}
+
+func TestShutdownLetsRunningCommandsFinish(t *testing.T) {
+	s, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	expectResponse(t, conn, reader, "set a 0 0 5\r\nhello\r\n", "STORED\r\n")
+
+	// holding the store keeps the next command running until the test lets go of it
+	unlock := s.Store.LockAll(true)
+
+	if _, err := conn.Write([]byte("get a\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// give the command time to be read, it then waits for the store
+	time.Sleep(100 * time.Millisecond)
+
+	shutdown := make(chan error, 1)
+
+	go func() {
+		shutdown <- s.Shutdown(context.Background())
+	}()
+
+	select {
+	case err := <-shutdown:
+		t.Fatalf("expected: shutdown to wait for the running command, it returned: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	unlock()
+
+	if got := readResponse(t, reader, 3); got != "VALUE a 0 5\r\nhello\r\nEND\r\n" {
+		t.Fatalf("expected: the response of the running command, got: %q", got)
+	}
+
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	if _, err := reader.ReadByte(); err == nil {
+		t.Fatal("expected: the connection to be closed after its command")
+	}
+}
+
+func TestShutdownGivesUpAfterTheDeadline(t *testing.T) {
+	s, conn := startTestServer(t)
+
+	unlock := s.Store.LockAll(true)
+
+	if _, err := conn.Write([]byte("get a\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected: the deadline of the context, got: %v", err)
+	}
+
+	unlock()
+}
+
+func TestShutdownWaitsForRunningSnapshot(t *testing.T) {
+	s, _ := startTestServer(t)
+	s.SnapshotPath = filepath.Join(t.TempDir(), "memcache.snapshot")
+
+	// holding the store keeps the first periodic snapshot from being written
+	unlock := s.Store.LockAll(true)
+
+	s.RunSnapshots(10 * time.Millisecond)
+
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected: the shutdown to wait for the snapshot, got: %v", err)
+	}
+
+	unlock()
+}
+
+func TestShutdownSyncsOpLogAndWritesSnapshot(t *testing.T) {
+	s, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	dir := t.TempDir()
+
+	s.SnapshotPath = filepath.Join(dir, "memcache.snapshot")
+	s.SnapshotOnShutdown = true
+
+	if _, _, err := s.OpenOpLog(filepath.Join(dir, "memcache.oplog"), server.FsyncEverySec); err != nil {
+		t.Fatal(err)
+	}
+
+	expectResponse(t, conn, reader, "set a 0 0 5\r\nhello\r\n", "STORED\r\n")
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the mutation is in the operation log without waiting for the everysec sync
+	replayed, replayedConn := startTestServer(t)
+	replayedReader := bufio.NewReader(replayedConn)
+
+	if _, _, err := replayed.OpenOpLog(filepath.Join(dir, "memcache.oplog"), server.FsyncEverySec); err != nil {
+		t.Fatal(err)
+	}
+
+	expectResponse(t, replayedConn, replayedReader, "get a\r\n", "VALUE a 0 5\r\nhello\r\nEND\r\n")
+
+	restored, _ := startTestServer(t)
+	restored.SnapshotPath = s.SnapshotPath
+
+	if n, _, err := restored.Restore(); err != nil || n != 1 {
+		t.Fatalf("expected: 1 item in the snapshot, got: %d %v", n, err)
+	}
+}
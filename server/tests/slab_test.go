@@ -0,0 +1,103 @@
+package server
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/pschlafley/coding-challenges/go-memcache/types"
+)
+
+func TestSlabsGrowByFactor(t *testing.T) {
+	slabs := types.NewSlabs(types.StoreConfig{Factor: 2, ChunkSize: 48})
+
+	expected := []int{144, 288, 576}
+
+	for i, size := range expected {
+		if slabs.Classes[i].ChunkSize != size {
+			t.Fatalf("expected: class %d with chunk size %d, got: %d", i+1, size, slabs.Classes[i].ChunkSize)
+		}
+	}
+
+	if last := slabs.Classes[len(slabs.Classes)-1]; last.ChunkSize != types.MaxItemSize || last.PageSize != types.MaxItemSize {
+		t.Fatalf("expected: the last class to hold the largest item on a page of its own, got: %d", last.ChunkSize)
+	}
+
+	// the pages are cut into whole chunks
+	if first := slabs.Classes[0]; first.PageSize != 455*144 {
+		t.Fatalf("expected: a page of 455 chunks, got: %d", first.PageSize)
+	}
+
+	limited := types.NewSlabs(types.StoreConfig{Factor: 2, ChunkSize: 48, ItemSizeMax: 4096})
+
+	if last := limited.Classes[len(limited.Classes)-1]; last.ChunkSize != 4096 {
+		t.Fatalf("expected: the last class to hold items of up to the item size limit, got: %d", last.ChunkSize)
+	}
+}
+
+func TestStatsSlabs(t *testing.T) {
+	s, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	s.Store = newTestStore(1024*1024*8, 2)
+
+	expectResponse(t, conn, reader, "set a 0 0 1\r\na\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "set b 0 0 1\r\nb\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "set c 0 0 100\r\n"+strings.Repeat("c", 100)+"\r\n", "STORED\r\n")
+
+	stats := readStats(t, conn, reader, "stats slabs")
+
+	expected := map[string]string{
+		"1:chunk_size":      "144",
+		"1:chunks_per_page": "455",
+		"1:total_pages":     "1",
+		"1:used_chunks":     "2",
+		"1:free_chunks":     "453",
+		"2:chunk_size":      "288",
+		"2:used_chunks":     "1",
+		"active_slabs":      "2",
+		"total_malloced":    "130896",
+	}
+
+	for name, value := range expected {
+		if stats[name] != value {
+			t.Fatalf("expected= %s %s, got= %s", name, value, stats[name])
+		}
+	}
+
+	items := readStats(t, conn, reader, "stats items")
+
+	if items["items:1:number"] != "2" || items["items:2:number"] != "1" {
+		t.Fatalf("expected= 2 items in class 1 and 1 in class 2, got= %v", items)
+	}
+
+	expectResponse(t, conn, reader, "delete a\r\n", "DELETED\r\n")
+
+	if stats := readStats(t, conn, reader, "stats slabs"); stats["1:used_chunks"] != "1" || stats["1:free_chunks"] != "454" {
+		t.Fatalf("expected= the chunk of a to be free again, got= %v", stats)
+	}
+}
+
+func TestEvictFromOwnSlabClass(t *testing.T) {
+	s, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	large := strings.Repeat("l", 100)
+
+	// a page for a large item and one for two small ones
+	s.Store = types.NewStore(types.StoreConfig{MaxBytes: 2 * 288, Factor: 2, ChunkSize: 48, Shards: 1, PageSize: 288})
+
+	expectResponse(t, conn, reader, "set l 0 0 100\r\n"+large+"\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "set a 0 0 1\r\na\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "set b 0 0 1\r\nb\r\n", "STORED\r\n")
+
+	// l is the least recently used item overall but c is only competing with the items of its own class
+	expectResponse(t, conn, reader, "set c 0 0 1\r\nc\r\n", "STORED\r\n")
+
+	expectResponse(t, conn, reader, "get a\r\n", "END\r\n")
+	expectResponse(t, conn, reader, "get l b c\r\n", "VALUE l 0 100\r\n"+large+"\r\nVALUE b 0 1\r\nb\r\nVALUE c 0 1\r\nc\r\nEND\r\n")
+
+	if items := readStats(t, conn, reader, "stats items"); items["items:1:evicted"] != "1" || items["items:2:evicted"] != "0" {
+		t.Fatalf("expected= 1 eviction in class 1, got= %v", items)
+	}
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pschlafley/coding-challenges/go-memcache/types"
+)
+
+func TestSnapshotAndRestore(t *testing.T) {
+	s, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	s.SnapshotPath = filepath.Join(t.TempDir(), "memcache.snapshot")
+
+	expectResponse(t, conn, reader, "set a 5 0 5\r\nhello\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "set b 0 100 3\r\nbin\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "set gone 0 1 1\r\ng\r\n", "STORED\r\n")
+
+	cas := getsCas(t, reader, conn, "a")
+
+	expectResponse(t, conn, reader, "snapshot\r\n", "OK\r\n")
+
+	time.Sleep(2100 * time.Millisecond)
+
+	restored, restoredConn := startTestServer(t)
+	restoredReader := bufio.NewReader(restoredConn)
+
+	restored.SnapshotPath = s.SnapshotPath
+
+	n, _, err := restored.Restore()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the item with the short ttl has expired since the snapshot was taken
+	if n != 2 {
+		t.Fatalf("expected: 2 restored items, got: %d", n)
+	}
+
+	if restoredCas := getsCas(t, restoredReader, restoredConn, "a"); restoredCas != cas {
+		t.Fatalf("expected: cas %s, got: %s", cas, restoredCas)
+	}
+
+	expectResponse(t, restoredConn, restoredReader, "get a b gone\r\n", "VALUE a 5 5\r\nhello\r\nVALUE b 0 3\r\nbin\r\nEND\r\n")
+
+	// new cas uniques are handed out after the restored ones
+	expectResponse(t, restoredConn, restoredReader, "set c 0 0 1\r\nc\r\n", "STORED\r\n")
+
+	oldCas, _ := strconv.ParseUint(cas, 10, 64)
+	newCas, _ := strconv.ParseUint(getsCas(t, restoredReader, restoredConn, "c"), 10, 64)
+
+	if newCas <= oldCas {
+		t.Fatalf("expected: a cas after %d, got: %d", oldCas, newCas)
+	}
+}
+
+func TestRestoreSkipsItemsThatDontFit(t *testing.T) {
+	s, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	s.SnapshotPath = filepath.Join(t.TempDir(), "memcache.snapshot")
+
+	expectResponse(t, conn, reader, "set a 0 0 1\r\na\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "set b 0 0 1\r\nb\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "set c 0 0 1\r\nc\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "set large 0 0 400\r\n"+strings.Repeat("l", 400)+"\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "snapshot\r\n", "OK\r\n")
+
+	restored, _ := startTestServer(t)
+
+	// a single page with room for two small items, the large one is too large for the memory limit
+	restored.Store = newPagedStore(288, 288, types.EvictNone)
+	restored.SnapshotPath = s.SnapshotPath
+
+	n, skipped, err := restored.Restore()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 2 || skipped != 2 || restored.Store.Len() != 2 {
+		t.Fatalf("expected: 2 restored and 2 skipped items, got: %d restored, %d skipped", n, skipped)
+	}
+}
+
+func TestRestoreRejectsCorruptSnapshot(t *testing.T) {
+	s, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	s.SnapshotPath = filepath.Join(t.TempDir(), "memcache.snapshot")
+
+	expectResponse(t, conn, reader, "set a 0 0 5\r\nhello\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "snapshot\r\n", "OK\r\n")
+
+	data, err := os.ReadFile(s.SnapshotPath)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data[len(data)-6] ^= 0xff
+
+	if err := os.WriteFile(s.SnapshotPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := s.Restore(); err == nil {
+		t.Fatal("expected: the corrupt snapshot to be rejected")
+	}
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readStats sends the stats command and returns the STAT lines as a map
+func readStats(t *testing.T, conn net.Conn, reader *bufio.Reader, command string) map[string]string {
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	if _, err := conn.Write([]byte(command + "\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := make(map[string]string)
+
+	for {
+		line, err := reader.ReadString('\n')
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		line = strings.TrimSpace(line)
+
+		if line == "END" {
+			return stats
+		}
+
+		fields := strings.Fields(line)
+
+		if len(fields) != 3 || fields[0] != "STAT" {
+			t.Fatalf("expected= STAT <name> <value>, got= %q", line)
+		}
+
+		stats[fields[1]] = fields[2]
+	}
+}
+
+func TestStats(t *testing.T) {
+	_, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	expectResponse(t, conn, reader, "set a 0 0 5\r\nhello\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "get a\r\n", "VALUE a 0 5\r\nhello\r\nEND\r\n")
+	expectResponse(t, conn, reader, "get b\r\n", "END\r\n")
+
+	stats := readStats(t, conn, reader, "stats")
+
+	expected := map[string]string{
+		"cmd_get":           "2",
+		"cmd_set":           "1",
+		"get_hits":          "1",
+		"get_misses":        "1",
+		"curr_items":        "1",
+		"bytes":             "102",
+		"curr_connections":  "1",
+		"total_connections": "1",
+	}
+
+	for name, value := range expected {
+		if stats[name] != value {
+			t.Fatalf("expected= %s %s, got= %s", name, value, stats[name])
+		}
+	}
+}
+
+func TestStatsSubcommands(t *testing.T) {
+	_, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	expectResponse(t, conn, reader, "set a 0 0 5\r\nhello\r\n", "STORED\r\n")
+
+	if stats := readStats(t, conn, reader, "stats items"); stats["items:1:number"] != "1" {
+		t.Fatalf("expected= items:1:number 1, got= %v", stats)
+	}
+
+	if stats := readStats(t, conn, reader, "stats sizes"); stats["128"] != "1" {
+		t.Fatalf("expected= 128 1, got= %v", stats)
+	}
+
+	if stats := readStats(t, conn, reader, "stats settings"); stats["maxbytes"] == "" {
+		t.Fatalf("expected= maxbytes, got= %v", stats)
+	}
+
+	stats := readStats(t, conn, reader, "stats conns")
+
+	if stats["conn1:addr"] != "tcp:"+conn.LocalAddr().String() {
+		t.Fatalf("expected= conn1:addr tcp:%s, got= %v", conn.LocalAddr(), stats)
+	}
+}
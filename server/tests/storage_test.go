@@ -0,0 +1,143 @@
+package server
+
+import (
+	"bufio"
+	"testing"
+
+	"github.com/pschlafley/coding-challenges/go-memcache/types"
+)
+
+// fakeStorage answers every operation with err and records the calls the protocol layer makes
+type fakeStorage struct {
+	err   error
+	calls []string
+	delay int64
+	stats types.Stats
+}
+
+func (f *fakeStorage) record(call string) { f.calls = append(f.calls, call) }
+
+func (f *fakeStorage) Get(key string) (*types.DataArgs, bool) {
+	f.record("Get " + key)
+	return nil, false
+}
+
+func (f *fakeStorage) Set(item *types.DataArgs) error {
+	f.record("Set " + item.Key)
+	return f.err
+}
+
+func (f *fakeStorage) Restore(item *types.DataArgs) error {
+	f.record("Restore " + item.Key)
+	return f.err
+}
+
+func (f *fakeStorage) Add(item *types.DataArgs) error {
+	f.record("Add " + item.Key)
+	return f.err
+}
+
+func (f *fakeStorage) Replace(item *types.DataArgs) error {
+	f.record("Replace " + item.Key)
+	return f.err
+}
+
+func (f *fakeStorage) Append(key string, data []byte) (*types.DataArgs, error) {
+	f.record("Append " + key + " " + string(data))
+	return nil, f.err
+}
+
+func (f *fakeStorage) Prepend(key string, data []byte) (*types.DataArgs, error) {
+	f.record("Prepend " + key + " " + string(data))
+	return nil, f.err
+}
+
+func (f *fakeStorage) Delete(key string) bool {
+	f.record("Delete " + key)
+	return false
+}
+
+func (f *fakeStorage) Touch(key string, exptime int64) (*types.DataArgs, bool) {
+	f.record("Touch " + key)
+	return nil, false
+}
+
+func (f *fakeStorage) Update(key string, fn func(item *types.DataArgs)) (*types.DataArgs, bool) {
+	f.record("Update " + key)
+	return nil, false
+}
+
+func (f *fakeStorage) Incr(key string, delta uint64) (*types.DataArgs, error) {
+	f.record("Incr " + key)
+	return nil, f.err
+}
+
+func (f *fakeStorage) Decr(key string, delta uint64) (*types.DataArgs, error) {
+	f.record("Decr " + key)
+	return nil, f.err
+}
+
+func (f *fakeStorage) CAS(item *types.DataArgs, cas uint64) error {
+	f.record("CAS " + item.Key)
+	return f.err
+}
+
+func (f *fakeStorage) Flush(delay int64) {
+	f.record("Flush")
+	f.delay = delay
+}
+
+func (f *fakeStorage) FlushPoint() int64                          { return 0 }
+func (f *fakeStorage) RestoreFlush(at int64)                      {}
+func (f *fakeStorage) Len() int                                   { return 0 }
+func (f *fakeStorage) Range(fn func(item *types.DataArgs) bool)   {}
+func (f *fakeStorage) Bytes() int64                               { return 0 }
+func (f *fakeStorage) Stats() *types.Stats                        { return &f.stats }
+func (f *fakeStorage) Config() types.StoreConfig                  { return types.StoreConfig{} }
+func (f *fakeStorage) LockKeys(write bool, keys ...string) func() { return func() {} }
+func (f *fakeStorage) LockAll(write bool) func()                  { return func() {} }
+
+func TestProtocolAgainstFakeStorage(t *testing.T) {
+	s, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	fake := &fakeStorage{}
+	s.Store = fake
+
+	expectResponse(t, conn, reader, "set a 0 0 1\r\na\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "append a 0 0 1\r\nb\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "flush_all 10\r\n", "OK\r\n")
+
+	fake.err = types.ErrNotStored
+
+	expectResponse(t, conn, reader, "add a 0 0 1\r\na\r\n", "NOT_STORED\r\n")
+	expectResponse(t, conn, reader, "replace a 0 0 1\r\na\r\n", "NOT_STORED\r\n")
+
+	fake.err = types.ErrExists
+
+	expectResponse(t, conn, reader, "cas a 0 0 1 5\r\na\r\n", "EXISTS\r\n")
+
+	fake.err = types.ErrNonNumeric
+
+	expectResponse(t, conn, reader, "incr a 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+
+	fake.err = types.ErrTooLarge
+
+	expectResponse(t, conn, reader, "prepend a 0 0 1\r\nc\r\n", "SERVER_ERROR object too large for cache\r\n")
+
+	expected := []string{"Set a", "Append a b", "Flush", "Add a", "Replace a", "CAS a", "Incr a", "Prepend a c"}
+
+	if len(fake.calls) != len(expected) {
+		t.Fatalf("expected: %v, got: %v", expected, fake.calls)
+	}
+
+	for i := range expected {
+		if fake.calls[i] != expected[i] {
+			t.Fatalf("expected: %v, got: %v", expected, fake.calls)
+		}
+	}
+
+	if fake.delay != 10 {
+		t.Fatalf("expected: a flush delay of 10, got: %d", fake.delay)
+	}
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTouch(t *testing.T) {
+	_, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	expectResponse(t, conn, reader, "touch missing 10\r\n", "NOT_FOUND\r\n")
+	expectResponse(t, conn, reader, "set session 0 1 2\r\nid\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "touch session 100\r\n", "TOUCHED\r\n")
+
+	time.Sleep(2100 * time.Millisecond)
+
+	expectResponse(t, conn, reader, "get session\r\n", "VALUE session 0 2\r\nid\r\nEND\r\n")
+	expectResponse(t, conn, reader, "touch session -1\r\n", "TOUCHED\r\n")
+	expectResponse(t, conn, reader, "get session\r\n", "END\r\n")
+}
+
+func TestAbsoluteExptime(t *testing.T) {
+	_, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	now := time.Now().Unix()
+
+	// an exptime of more than 30 days is a unix time
+	expectResponse(t, conn, reader, fmt.Sprintf("set later 0 %d 1\r\nl\r\n", now+100), "STORED\r\n")
+	expectResponse(t, conn, reader, fmt.Sprintf("set passed 0 %d 1\r\np\r\n", now-100), "STORED\r\n")
+	expectResponse(t, conn, reader, "get later passed\r\n", "VALUE later 0 1\r\nl\r\nEND\r\n")
+
+	if _, err := conn.Write([]byte("mg later t\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	var ttl int64
+
+	if _, err := fmt.Sscanf(readResponse(t, reader, 1), "HD t%d\r\n", &ttl); err != nil || ttl < 98 || ttl > 100 {
+		t.Fatalf("expected: about 100 seconds left, got: %d %v", ttl, err)
+	}
+
+	expectResponse(t, conn, reader, fmt.Sprintf("touch later %d\r\n", now-100), "TOUCHED\r\n")
+	expectResponse(t, conn, reader, "get later\r\n", "END\r\n")
+}
+
+func TestGat(t *testing.T) {
+	_, conn := startTestServer(t)
+	reader := bufio.NewReader(conn)
+
+	expectResponse(t, conn, reader, "set a 1 0 1\r\na\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "set b 2 0 1\r\nb\r\n", "STORED\r\n")
+	expectResponse(t, conn, reader, "gat 100 a missing b\r\n", "VALUE a 1 1\r\na\r\nVALUE b 2 1\r\nb\r\nEND\r\n")
+	expectResponse(t, conn, reader, "gat -1 a\r\n", "VALUE a 1 1\r\na\r\nEND\r\n")
+	expectResponse(t, conn, reader, "gat 100 a\r\n", "END\r\n")
+}
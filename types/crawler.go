@@ -0,0 +1,77 @@
+package types
+
+import "time"
+
+// crawler is the position of the expiry crawler in the LRUs of the slab classes of a shard, it is kept
+// between the batches so that every sweep visits each item once
+type crawler struct {
+	// class is the index of the slab class that is being crawled
+	class int
+	// node is the next node to visit, nil once the class has been crawled to its end
+	node *Node[string]
+	// started is set once the crawler has picked up the head of the class
+	started bool
+}
+
+// CrawlExpired continues the current sweep of the expiry crawler for up to batch items and removes the
+// ones that have expired, it locks the shard it is sweeping by itself. It returns the amount of items it
+// has reclaimed and whether the sweep has reached the end of the last shard, the next call then starts a
+// new sweep
+func (s *Store) CrawlExpired(batch int) (int, bool) {
+	sh := s.shards[s.crawlShard]
+
+	sh.Lock()
+	reclaimed, done := sh.crawlExpired(batch)
+	sh.Unlock()
+
+	if !done {
+		return reclaimed, false
+	}
+
+	s.crawlShard = (s.crawlShard + 1) % len(s.shards)
+
+	return reclaimed, s.crawlShard == 0
+}
+
+func (sh *shard) crawlExpired(batch int) (int, bool) {
+	now := time.Now().Unix()
+	c := &sh.crawler
+	reclaimed := 0
+
+	for visited := 0; visited < batch; {
+		if c.node == nil {
+			if c.started {
+				c.class++
+			}
+
+			if c.class >= len(sh.slabs.Classes) {
+				*c = crawler{}
+				return reclaimed, true
+			}
+
+			c.node = sh.slabs.Classes[c.class].lru.Head()
+			c.started = true
+
+			continue
+		}
+
+		item := sh.db[c.node.Value()]
+		c.node = c.node.Next()
+		visited++
+
+		if sh.store.expired(item, now) {
+			sh.remove(item)
+			reclaimed++
+		}
+	}
+
+	return reclaimed, false
+}
+
+// skipCrawled moves the crawler past the node when it is about to be removed or moved to the back of
+// its LRU
+func (sh *shard) skipCrawled(node *Node[string]) {
+	if sh.crawler.node == node {
+		sh.crawler.node = node.Next()
+	}
+}
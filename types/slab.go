@@ -0,0 +1,224 @@
+package types
+
+import "sort"
+
+// MaxItemSize is the size of the largest item a store can be configured to accept
+const MaxItemSize = 1024 * 1024
+
+// DefaultPageSize is the size of the pages the slab classes cut their chunks from when the store is created
+// without a page size. The pages are charged against the memory limit of their shard, so they are kept
+// small enough for every shard to give pages to many classes
+const DefaultPageSize = 64 * 1024
+
+// chunkAlign is the alignment of the chunk sizes
+const chunkAlign = 8
+
+// SlabClass hands out chunks of a single size. The chunks are cut from pages that are allocated in one
+// go and are reused once their item is removed, so storing an item doesn't allocate after the class has
+// warmed up
+type SlabClass struct {
+	ID        int
+	ChunkSize int
+	// PageSize is the size of the pages of the class, a page holds at least one chunk
+	PageSize int
+	// Pages is the amount of pages the class holds
+	Pages int
+	// Used is the amount of chunks that hold an item
+	Used int
+	// Evictions is the amount of items of the class that have been evicted
+	Evictions uint64
+	free      []slabChunk
+	pages     []*slabPage
+	// lru holds the keys of the items of the class from the least to the most recently used
+	lru *Queue[string]
+}
+
+// slabPage is a page of a slab class, used is the amount of its chunks that hold an item
+type slabPage struct {
+	mem  []byte
+	used int
+}
+
+// slabChunk is a chunk together with the page it has been cut from
+type slabChunk struct {
+	mem  []byte
+	page *slabPage
+}
+
+// ChunksPerPage is the amount of chunks a single page is cut into
+func (c *SlabClass) ChunksPerPage() int {
+	return c.PageSize / c.ChunkSize
+}
+
+// FreeChunks is the amount of chunks that have been cut from the pages but hold no item
+func (c *SlabClass) FreeChunks() int {
+	return len(c.free)
+}
+
+// grow allocates a new page and cuts it into chunks, the shard has to charge it against its memory limit
+func (c *SlabClass) grow() {
+	page := &slabPage{mem: make([]byte, c.PageSize)}
+
+	for i := 0; i+c.ChunkSize <= c.PageSize; i += c.ChunkSize {
+		c.free = append(c.free, slabChunk{mem: page.mem[i : i+c.ChunkSize : i+c.ChunkSize], page: page})
+	}
+
+	c.pages = append(c.pages, page)
+	c.Pages++
+}
+
+// alloc returns a free chunk, false is returned when every chunk of the class holds an item
+func (c *SlabClass) alloc() (slabChunk, bool) {
+	if len(c.free) == 0 {
+		return slabChunk{}, false
+	}
+
+	chunk := c.free[len(c.free)-1]
+	c.free = c.free[:len(c.free)-1]
+	chunk.page.used++
+	c.Used++
+
+	return chunk, true
+}
+
+func (c *SlabClass) release(chunk slabChunk) {
+	c.free = append(c.free, chunk)
+	chunk.page.used--
+	c.Used--
+}
+
+// emptiestPage returns the page with the fewest items, nil when the class has no pages
+func (c *SlabClass) emptiestPage() *slabPage {
+	var emptiest *slabPage
+
+	for _, page := range c.pages {
+		if emptiest == nil || page.used < emptiest.used {
+			emptiest = page
+		}
+	}
+
+	return emptiest
+}
+
+// dropPage takes a page whose chunks hold no items out of the class, so its memory can go to another class
+func (c *SlabClass) dropPage(page *slabPage) {
+	free := c.free[:0]
+
+	for _, chunk := range c.free {
+		if chunk.page != page {
+			free = append(free, chunk)
+		}
+	}
+
+	clear(c.free[len(free):])
+	c.free = free
+
+	for i, p := range c.pages {
+		if p == page {
+			c.pages = append(c.pages[:i], c.pages[i+1:]...)
+			break
+		}
+	}
+
+	c.Pages--
+}
+
+// Slabs are the slab classes of the store ordered by their chunk size, every chunk size is the one
+// before it multiplied by the growth factor and the last class holds items of up to ItemSizeMax
+type Slabs struct {
+	Classes []*SlabClass
+	// Factor is the growth factor between the chunk sizes of the classes
+	Factor float64
+	// ChunkSize is the space for the key and value of the smallest class on top of the item overhead
+	ChunkSize int
+}
+
+// NewSlabs builds the slab classes from the growth factor, the chunk size of the smallest class, the
+// item size limit and the page size of the config
+func NewSlabs(config StoreConfig) *Slabs {
+	config = config.withDefaults()
+	slabs := &Slabs{Factor: config.Factor, ChunkSize: config.ChunkSize}
+
+	size := alignChunk(ItemOverhead + config.ChunkSize)
+
+	for float64(size) <= float64(config.ItemSizeMax)/config.Factor {
+		slabs.addClass(size, config.PageSize)
+
+		next := alignChunk(int(float64(size) * config.Factor))
+
+		// a factor close to 1 must still grow the chunks
+		if next <= size {
+			next = size + chunkAlign
+		}
+
+		size = next
+	}
+
+	slabs.addClass(int(config.ItemSizeMax), config.PageSize)
+
+	return slabs
+}
+
+// addClass adds a class whose pages are cut into as many chunks as fit into the page size, at least one
+func (sl *Slabs) addClass(chunkSize int, pageSize int) {
+	chunks := max(pageSize/chunkSize, 1)
+
+	sl.Classes = append(sl.Classes, &SlabClass{
+		ID:        len(sl.Classes) + 1,
+		ChunkSize: chunkSize,
+		PageSize:  chunks * chunkSize,
+		lru:       NewQueue[string](),
+	})
+}
+
+// classFor returns the smallest class whose chunks fit an item of the size, nil is returned when the
+// item is larger than ItemSizeMax
+func (sl *Slabs) classFor(size int64) *SlabClass {
+	i := sort.Search(len(sl.Classes), func(i int) bool {
+		return int64(sl.Classes[i].ChunkSize) >= size
+	})
+
+	if i == len(sl.Classes) {
+		return nil
+	}
+
+	return sl.Classes[i]
+}
+
+func alignChunk(size int) int {
+	return (size + chunkAlign - 1) / chunkAlign * chunkAlign
+}
+
+// SlabStats are the counters of a slab class summed up over every shard
+type SlabStats struct {
+	ID            int
+	ChunkSize     int
+	PageSize      int
+	ChunksPerPage int
+	Pages         int
+	Used          int
+	Free          int
+	Evictions     uint64
+}
+
+// SlabStats returns the counters of every slab class, the shards have to be locked for reading
+func (s *Store) SlabStats() []SlabStats {
+	stats := make([]SlabStats, len(s.shards[0].slabs.Classes))
+
+	for _, sh := range s.shards {
+		for i, class := range sh.slabs.Classes {
+			st := &stats[i]
+
+			st.ID = class.ID
+			st.ChunkSize = class.ChunkSize
+			st.PageSize = class.PageSize
+			st.ChunksPerPage = class.ChunksPerPage()
+			st.Pages += class.Pages
+			st.Used += class.Used
+			st.Free += class.FreeChunks()
+			st.Evictions += class.Evictions
+		}
+	}
+
+	return stats
+}
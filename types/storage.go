@@ -0,0 +1,85 @@
+package types
+
+import "errors"
+
+var (
+	// ErrNotStored is returned when an item was not stored because the condition of the operation was not met
+	ErrNotStored = errors.New("not stored")
+	// ErrNotFound is returned when the key of the operation is not in the storage
+	ErrNotFound = errors.New("not found")
+	// ErrExists is returned by CAS when the item has been modified since the client fetched it
+	ErrExists = errors.New("exists")
+	// ErrNonNumeric is returned by Incr and Decr when the value of the item is not a number
+	ErrNonNumeric = errors.New("cannot increment or decrement non-numeric value")
+	// ErrTooLarge is returned when the item does not fit into the storage even if it was empty
+	ErrTooLarge = errors.New("object too large for cache")
+	// ErrOutOfMemory is returned when evictions are turned off and the item does not fit into the memory limit
+	ErrOutOfMemory = errors.New("out of memory storing object")
+)
+
+// Storage is the engine the protocol handlers keep the items in. The handlers lock the keys of a command
+// with LockKeys, or the whole storage with LockAll, and call the other methods while they hold the lock,
+// so the methods themselves don't lock. Exptimes are absolute unix times, -1 expires the item right away
+type Storage interface {
+	// Get looks up the key, expired items are reported as missing
+	Get(key string) (*DataArgs, bool)
+	// Set writes the item and gives it a new cas unique
+	Set(item *DataArgs) error
+	// Restore writes an item that was stored before, like one loaded from disk, and keeps its cas unique and
+	// the time it was stored at
+	Restore(item *DataArgs) error
+	// Add stores the item only if the key is not stored yet, ErrNotStored is returned otherwise
+	Add(item *DataArgs) error
+	// Replace stores the item only if the key is already stored, ErrNotStored is returned otherwise
+	Replace(item *DataArgs) error
+	// Append adds the data after the value of the stored item, ErrNotStored is returned when it is missing
+	Append(key string, data []byte) (*DataArgs, error)
+	// Prepend adds the data before the value of the stored item, ErrNotStored is returned when it is missing
+	Prepend(key string, data []byte) (*DataArgs, error)
+	// Delete removes the key and reports whether it was there
+	Delete(key string) bool
+	// Touch updates the exptime of the item without changing its cas unique
+	Touch(key string, exptime int64) (*DataArgs, bool)
+	// Update lets fn change the exptime, the flags or the meta protocol state of the item without changing
+	// its value or cas unique, fn must not touch the key or the value
+	Update(key string, fn func(item *DataArgs)) (*DataArgs, bool)
+	// Incr adds the delta to the value of the item as a 64-bit unsigned number that wraps around on overflow
+	Incr(key string, delta uint64) (*DataArgs, error)
+	// Decr subtracts the delta from the value of the item, the value stops at 0
+	Decr(key string, delta uint64) (*DataArgs, error)
+	// CAS stores the item only if the cas unique of the stored item matches, ErrNotFound or ErrExists is
+	// returned otherwise
+	CAS(item *DataArgs, cas uint64) error
+	// Flush removes every item right away, with a delay in seconds every item stored before the flush
+	// point becomes invalid once it is reached
+	Flush(delay int64)
+	// FlushPoint is the unix time of the last delayed flush, 0 when there is none
+	FlushPoint() int64
+	// RestoreFlush brings back the point of a delayed flush that was done before, like one loaded from disk,
+	// the items stored before the unix time are invalid once it has passed
+	RestoreFlush(at int64)
+	// Len is the amount of items, including the expired ones that haven't been removed yet
+	Len() int
+	// Range calls fn for every item until it returns false
+	Range(fn func(item *DataArgs) bool)
+	// Bytes is the amount of memory the items take up
+	Bytes() int64
+	// Stats returns the counters that are reported by the stats command
+	Stats() *Stats
+	// Config returns the settings the storage was created with
+	Config() StoreConfig
+	// LockKeys locks the keys for writing, or for reading when write is false, and returns the unlock function
+	LockKeys(write bool, keys ...string) func()
+	// LockAll locks the whole storage and returns the unlock function
+	LockAll(write bool) func()
+}
+
+// SlabStorage is implemented by the storages that keep their items in slab classes
+type SlabStorage interface {
+	SlabStats() []SlabStats
+}
+
+// CrawledStorage is implemented by the storages whose expired items are removed by the expiry crawler
+type CrawledStorage interface {
+	CrawlExpired(batch int) (int, bool)
+}
@@ -0,0 +1,642 @@
+package types
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ItemOverhead is the amount of bytes that is accounted for the metadata of every item on top of its key
+// and value, it covers the DataArgs struct, the map entry and the LRU node
+const ItemOverhead = 96
+
+var _ Storage = (*Store)(nil)
+
+// StoreConfig holds the settings a store is created with
+type StoreConfig struct {
+	// MaxBytes is the memory limit of the store. Every shard gets MaxBytes/Shards of it for the pages of
+	// its slab classes and evicts on its own once its share is used up, even while other shards have room
+	// left, so the share has to be at least ItemSizeMax for the largest items to fit
+	MaxBytes int64
+	// Factor is the growth factor between the chunk sizes of the slab classes
+	Factor float64
+	// ChunkSize is the space for the key and value in the smallest slab class
+	ChunkSize int
+	// Shards is the amount of shards the items are spread over
+	Shards int
+	// ItemSizeMax is the size of the largest item the store takes, 0 means MaxItemSize
+	ItemSizeMax int64
+	// PageSize is the size of the pages the slab classes cut their chunks from, 0 means DefaultPageSize.
+	// Classes whose chunks are larger get pages of a single chunk
+	PageSize int
+	// EvictionPolicy is what happens to a write when a shard is full, EvictLRU (or empty) evicts the
+	// least recently used items and EvictNone fails the write with ErrOutOfMemory
+	EvictionPolicy string
+}
+
+const (
+	// EvictLRU evicts the least recently used items to make room for a write
+	EvictLRU = "lru"
+	// EvictNone never evicts an item, writes that don't fit fail instead
+	EvictNone = "none"
+)
+
+// withDefaults fills in the settings that have been left out
+func (config StoreConfig) withDefaults() StoreConfig {
+	if config.ItemSizeMax <= 0 || config.ItemSizeMax > MaxItemSize {
+		config.ItemSizeMax = MaxItemSize
+	}
+
+	if config.PageSize <= 0 {
+		config.PageSize = DefaultPageSize
+	}
+
+	if config.EvictionPolicy == "" {
+		config.EvictionPolicy = EvictLRU
+	}
+
+	return config
+}
+
+// shard holds a part of the items with its own LRUs, slab classes and share of the memory limit. The
+// pages of the slab classes are charged against the memory limit, bytes is the size of the items
+type shard struct {
+	sync.RWMutex
+	store    *Store
+	db       map[string]*DataArgs
+	bytes    int64
+	malloced int64
+	maxBytes int64
+	slabs    *Slabs
+	// crawler is the position of the expiry crawler in the shard
+	crawler crawler
+}
+
+// NewStore creates an empty store, every shard may use an even share of the memory limit for the pages
+// of its slab classes and builds the classes from the growth factor and the chunk size of the smallest class.
+// Items whose slab class has pages larger than the share of a shard are rejected with ErrTooLarge
+func NewStore(config StoreConfig) *Store {
+	config = config.withDefaults()
+
+	store := &Store{
+		shards: make([]*shard, config.Shards),
+		config: config,
+	}
+
+	for i := range store.shards {
+		store.shards[i] = &shard{
+			store:    store,
+			db:       make(map[string]*DataArgs),
+			maxBytes: config.MaxBytes / int64(config.Shards),
+			slabs:    NewSlabs(config),
+		}
+	}
+
+	return store
+}
+
+// Size is the amount of memory the item takes up in the store
+func (item *DataArgs) Size() int64 {
+	return int64(len(item.Key)+len(item.DataBlock)) + ItemOverhead
+}
+
+// Class is the id of the slab class the item is stored in, 0 means it is not stored
+func (item *DataArgs) Class() int {
+	if item.class == nil {
+		return 0
+	}
+
+	return item.class.ID
+}
+
+func (s *Store) shardIndex(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+
+	return int(h.Sum32() % uint32(len(s.shards)))
+}
+
+func (s *Store) shard(key string) *shard {
+	return s.shards[s.shardIndex(key)]
+}
+
+// LockKeys locks the shards of the keys for writing, or for reading when write is false, and returns the
+// function that unlocks them again. The shards are always locked in the same order so that commands with
+// several keys can't deadlock each other
+func (s *Store) LockKeys(write bool, keys ...string) func() {
+	indexes := make([]int, 0, len(keys))
+
+	for _, key := range keys {
+		indexes = append(indexes, s.shardIndex(key))
+	}
+
+	sort.Ints(indexes)
+
+	var locked []*shard
+
+	for i, idx := range indexes {
+		if i > 0 && idx == indexes[i-1] {
+			continue
+		}
+
+		locked = append(locked, s.shards[idx])
+	}
+
+	return s.lock(write, locked)
+}
+
+// LockAll locks every shard, for writing or for reading when write is false, and returns the function that
+// unlocks them again
+func (s *Store) LockAll(write bool) func() {
+	return s.lock(write, s.shards)
+}
+
+func (s *Store) lock(write bool, shards []*shard) func() {
+	for _, sh := range shards {
+		if write {
+			sh.Lock()
+		} else {
+			sh.RLock()
+		}
+	}
+
+	return func() {
+		for i := len(shards) - 1; i >= 0; i-- {
+			if write {
+				shards[i].Unlock()
+			} else {
+				shards[i].RUnlock()
+			}
+		}
+	}
+}
+
+// expired reports whether the item has expired or has been invalidated by a delayed flush_all
+func (s *Store) expired(item *DataArgs, now int64) bool {
+	if item.Exptime < 0 || (item.Exptime > 0 && now > item.Exptime) {
+		return true
+	}
+
+	// a delayed flush_all has passed since the item was stored
+	return s.oldestLive != 0 && now >= s.oldestLive && item.Time < s.oldestLive
+}
+
+// Stats returns the counters of the store
+func (s *Store) Stats() *Stats {
+	return &s.stats
+}
+
+// Config returns the settings the store was created with
+func (s *Store) Config() StoreConfig {
+	return s.config
+}
+
+// Get looks up the key and marks the item as the most recently used one of its slab class, expired items
+// are removed from the store and reported as missing
+func (s *Store) Get(key string) (*DataArgs, bool) {
+	return s.shard(key).get(key)
+}
+
+// Set writes the item into the store and gives it a new cas unique, every modification of an item has
+// to go through here so that cas can detect it. The key and the value are copied into a chunk of the
+// slab class that fits the item, items are evicted when the class has no free chunk and the shard can't
+// give it another page. An item that is too large replaces the old value with nothing and ErrTooLarge is
+// returned. With EvictNone the old value is kept and ErrOutOfMemory is returned instead of evicting
+func (s *Store) Set(item *DataArgs) error {
+	return s.shard(item.Key).set(item)
+}
+
+// Delete removes the key from the store and reports whether it was there
+func (s *Store) Delete(key string) bool {
+	return s.shard(key).delete(key)
+}
+
+// Restore stores the item with the cas unique and the store time it already has, the cas counter is
+// moved past it so that the new cas uniques never collide with the restored ones
+func (s *Store) Restore(item *DataArgs) error {
+	cas, stored := item.Cas, item.Time
+
+	if err := s.Set(item); err != nil {
+		return err
+	}
+
+	item.Cas = cas
+	item.Time = stored
+
+	for {
+		current := atomic.LoadUint64(&s.casUnique)
+
+		if current >= cas || atomic.CompareAndSwapUint64(&s.casUnique, current, cas) {
+			return nil
+		}
+	}
+}
+
+// Add stores the item only if the key is not stored yet
+func (s *Store) Add(item *DataArgs) error {
+	if _, ok := s.Get(item.Key); ok {
+		return ErrNotStored
+	}
+
+	return s.Set(item)
+}
+
+// Replace stores the item only if the key is already stored
+func (s *Store) Replace(item *DataArgs) error {
+	if _, ok := s.Get(item.Key); !ok {
+		return ErrNotStored
+	}
+
+	return s.Set(item)
+}
+
+// Append adds the data after the value of the stored item
+func (s *Store) Append(key string, data []byte) (*DataArgs, error) {
+	return s.concat(key, data, false)
+}
+
+// Prepend adds the data before the value of the stored item
+func (s *Store) Prepend(key string, data []byte) (*DataArgs, error) {
+	return s.concat(key, data, true)
+}
+
+func (s *Store) concat(key string, data []byte, prepend bool) (*DataArgs, error) {
+	item, ok := s.Get(key)
+
+	if !ok {
+		return nil, ErrNotStored
+	}
+
+	// build a new slice so that the stored value never shares its backing array with the data
+	dataBlock := make([]byte, 0, len(item.DataBlock)+len(data))
+
+	if prepend {
+		dataBlock = append(append(dataBlock, data...), item.DataBlock...)
+	} else {
+		dataBlock = append(append(dataBlock, item.DataBlock...), data...)
+	}
+
+	// the stored item keeps its value until the new one is stored, with EvictNone it stays when there is
+	// no room for the new one
+	updated := *item
+	updated.DataBlock = dataBlock
+	updated.ByteCt = len(dataBlock)
+
+	return &updated, s.Set(&updated)
+}
+
+// Touch updates the exptime of the item, the cas unique stays the same since the value is unchanged
+func (s *Store) Touch(key string, exptime int64) (*DataArgs, bool) {
+	return s.Update(key, func(item *DataArgs) {
+		item.Exptime = exptime
+	})
+}
+
+// Update changes the item in place, the key and the value stay in the chunk they were copied to
+func (s *Store) Update(key string, fn func(item *DataArgs)) (*DataArgs, bool) {
+	item, ok := s.Get(key)
+
+	if ok {
+		fn(item)
+	}
+
+	return item, ok
+}
+
+// Incr adds the delta to the value of the item, the value wraps around on overflow
+func (s *Store) Incr(key string, delta uint64) (*DataArgs, error) {
+	return s.arithmetic(key, func(value uint64) uint64 {
+		return value + delta
+	})
+}
+
+// Decr subtracts the delta from the value of the item, the value stops at 0
+func (s *Store) Decr(key string, delta uint64) (*DataArgs, error) {
+	return s.arithmetic(key, func(value uint64) uint64 {
+		if delta > value {
+			return 0
+		}
+
+		return value - delta
+	})
+}
+
+func (s *Store) arithmetic(key string, op func(value uint64) uint64) (*DataArgs, error) {
+	item, ok := s.Get(key)
+
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	value, err := strconv.ParseUint(string(item.DataBlock), 10, 64)
+
+	if err != nil {
+		return nil, ErrNonNumeric
+	}
+
+	updated := *item
+	updated.DataBlock = []byte(strconv.FormatUint(op(value), 10))
+	updated.ByteCt = len(updated.DataBlock)
+
+	return &updated, s.Set(&updated)
+}
+
+// CAS stores the item only if nobody else has modified it since the client fetched the cas unique
+func (s *Store) CAS(item *DataArgs, cas uint64) error {
+	old, ok := s.Get(item.Key)
+
+	if !ok {
+		return ErrNotFound
+	}
+
+	if old.Cas != cas {
+		return ErrExists
+	}
+
+	return s.Set(item)
+}
+
+// Flush removes every item from the store, the chunks stay with their slab class. With a delay the
+// items are removed lazily by Get and the crawler once the flush point has passed
+func (s *Store) Flush(delay int64) {
+	if delay > 0 {
+		s.oldestLive = time.Now().Unix() + delay
+		return
+	}
+
+	for _, sh := range s.shards {
+		for _, item := range sh.db {
+			sh.remove(item)
+		}
+	}
+
+	s.oldestLive = 0
+}
+
+// FlushPoint is the unix time of the last delayed flush_all, 0 when there is none
+func (s *Store) FlushPoint() int64 {
+	return s.oldestLive
+}
+
+// RestoreFlush sets the point of a delayed flush_all that was done before, the items stored before it
+// are removed lazily once it has passed like they are after Flush
+func (s *Store) RestoreFlush(at int64) {
+	s.oldestLive = at
+}
+
+// Len is the amount of items in the store, including the expired ones that haven't been removed yet
+func (s *Store) Len() int {
+	n := 0
+
+	for _, sh := range s.shards {
+		n += len(sh.db)
+	}
+
+	return n
+}
+
+// Shards is the amount of shards the items are spread over
+func (s *Store) Shards() int {
+	return len(s.shards)
+}
+
+// Bytes is the amount of memory the stored items take up
+func (s *Store) Bytes() int64 {
+	var n int64
+
+	for _, sh := range s.shards {
+		n += sh.bytes
+	}
+
+	return n
+}
+
+// Range calls fn for every item in the store until it returns false
+func (s *Store) Range(fn func(item *DataArgs) bool) {
+	for _, sh := range s.shards {
+		for _, item := range sh.db {
+			if !fn(item) {
+				return
+			}
+		}
+	}
+}
+
+func (sh *shard) get(key string) (*DataArgs, bool) {
+	item, ok := sh.db[key]
+
+	if !ok {
+		return nil, false
+	}
+
+	if sh.store.expired(item, time.Now().Unix()) {
+		sh.remove(item)
+		return nil, false
+	}
+
+	sh.skipCrawled(item.node)
+	item.class.lru.MoveToBack(item.node)
+
+	return item, true
+}
+
+func (sh *shard) set(item *DataArgs) error {
+	size := item.Size()
+	class := sh.slabs.classFor(size)
+
+	if class == nil || int64(class.PageSize) > sh.maxBytes {
+		if old, ok := sh.db[item.Key]; ok {
+			sh.remove(old)
+		}
+
+		return ErrTooLarge
+	}
+
+	// the chunk of the old value is reused when it is in the same class, without evictions the old value
+	// is only removed once the new one has a chunk
+	if old, ok := sh.db[item.Key]; ok && (sh.store.config.EvictionPolicy != EvictNone || old.class == class) {
+		sh.remove(old)
+	}
+
+	chunk, err := sh.alloc(class)
+
+	if err != nil {
+		return err
+	}
+
+	if old, ok := sh.db[item.Key]; ok {
+		sh.remove(old)
+	}
+
+	item.Cas = atomic.AddUint64(&sh.store.casUnique, 1)
+	item.Time = time.Now().Unix()
+
+	sh.store.stats.TotalItems.Add(1)
+
+	// the value may still point into the chunk the item has just released, copy handles the overlap
+	keyLen := copy(chunk.mem, item.Key)
+	valueLen := copy(chunk.mem[keyLen:], item.DataBlock)
+
+	item.DataBlock = chunk.mem[keyLen : keyLen+valueLen : keyLen+valueLen]
+	item.chunk = chunk
+	item.class = class
+	item.node = class.lru.Enque(item.Key)
+	item.size = size
+
+	sh.db[item.Key] = item
+	sh.bytes += size
+
+	return nil
+}
+
+// alloc returns a free chunk of the class. A class without free chunks gets a new page while the pages of
+// the shard are below its memory limit, after that it gets the memory of a page another class isn't using.
+// Only then are items evicted: the least recently used item of the class, or when the class holds no
+// items, the items on the page of another class that has the fewest of them so the page can be moved.
+// Without evictions the expired items of the shard are reclaimed before the store runs out of memory
+func (sh *shard) alloc(class *SlabClass) (slabChunk, error) {
+	reclaimed := false
+
+	for {
+		if chunk, ok := class.alloc(); ok {
+			return chunk, nil
+		}
+
+		if sh.malloced+int64(class.PageSize) <= sh.maxBytes {
+			class.grow()
+			sh.malloced += int64(class.PageSize)
+
+			continue
+		}
+
+		if sh.dropEmptyPage() {
+			continue
+		}
+
+		// without evictions only the memory of expired items can be taken, they are all reclaimed at once
+		// so that their pages can be freed as well
+		if sh.store.config.EvictionPolicy == EvictNone {
+			if !reclaimed {
+				reclaimed = true
+
+				if sh.reclaimExpired() > 0 {
+					continue
+				}
+			}
+
+			return slabChunk{}, ErrOutOfMemory
+		}
+
+		if class.lru.Len() > 0 {
+			sh.evict(sh.db[class.lru.Head().Value()])
+			continue
+		}
+
+		if !sh.evictPage(class) {
+			return slabChunk{}, ErrOutOfMemory
+		}
+	}
+}
+
+// reclaimExpired removes the items of the shard that have expired and returns how many there were
+func (sh *shard) reclaimExpired() int {
+	now := time.Now().Unix()
+	reclaimed := 0
+
+	for _, item := range sh.db {
+		if sh.store.expired(item, now) {
+			sh.remove(item)
+			reclaimed++
+		}
+	}
+
+	return reclaimed
+}
+
+// dropEmptyPage frees a page whose chunks hold no items, false is returned when there is none
+func (sh *shard) dropEmptyPage() bool {
+	for _, class := range sh.slabs.Classes {
+		for _, page := range class.pages {
+			if page.used == 0 {
+				class.dropPage(page)
+				sh.malloced -= int64(class.PageSize)
+
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// evictPage evicts the items on the page with the fewest items of the other classes and frees the page,
+// false is returned when no other class has a page
+func (sh *shard) evictPage(target *SlabClass) bool {
+	var victim *SlabClass
+	var page *slabPage
+
+	for _, class := range sh.slabs.Classes {
+		if class == target {
+			continue
+		}
+
+		if p := class.emptiestPage(); p != nil && (page == nil || p.used < page.used) {
+			victim, page = class, p
+		}
+	}
+
+	if page == nil {
+		return false
+	}
+
+	for node := victim.lru.Head(); node != nil && page.used > 0; {
+		item := sh.db[node.Value()]
+		node = node.Next()
+
+		if item.chunk.page == page {
+			sh.evict(item)
+		}
+	}
+
+	victim.dropPage(page)
+	sh.malloced -= int64(victim.PageSize)
+
+	return true
+}
+
+func (sh *shard) delete(key string) bool {
+	item, ok := sh.db[key]
+
+	if ok {
+		sh.remove(item)
+	}
+
+	return ok
+}
+
+// evict removes the item to make room for another one, items that have already expired are reclaimed
+// without counting as an eviction
+func (sh *shard) evict(item *DataArgs) {
+	if !sh.store.expired(item, time.Now().Unix()) {
+		item.class.Evictions++
+		sh.store.stats.Evictions.Add(1)
+	}
+
+	sh.remove(item)
+}
+
+func (sh *shard) remove(item *DataArgs) {
+	sh.skipCrawled(item.node)
+	item.class.lru.Remove(item.node)
+	item.class.release(item.chunk)
+
+	item.node = nil
+	item.chunk = slabChunk{}
+	item.class = nil
+
+	delete(sh.db, item.Key)
+	sh.bytes -= item.size
+}
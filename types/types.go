@@ -2,6 +2,8 @@ package types
 
 import (
 	"net"
+	"sync/atomic"
+	"time"
 )
 
 type Node[T any] struct {
@@ -21,11 +23,19 @@ func (n *Node[T]) Next() *Node[T] {
 type Queue[T any] struct {
 	head *Node[T]
 	tail *Node[T]
+	len  int
 }
 
-func (q *Queue[T]) Enque(item T) {
+// Enque adds the item to the back of the queue and returns its node so that it can be moved or removed later on
+func (q *Queue[T]) Enque(item T) *Node[T] {
 	var newNode *Node[T] = &Node[T]{value: item}
 
+	q.pushNode(newNode)
+
+	return newNode
+}
+
+func (q *Queue[T]) pushNode(newNode *Node[T]) {
 	if q.head == nil {
 		q.head = newNode
 		q.tail = newNode
@@ -35,18 +45,54 @@ func (q *Queue[T]) Enque(item T) {
 		newNode.prev = oldNode
 		q.tail = newNode
 	}
+
+	q.len++
 }
 
 func (q *Queue[T]) Deque() *Queue[T] {
 	node := q.head
 
-	q.head = node.next
+	if node == nil {
+		return q
+	}
+
+	q.Remove(node)
+
+	return q
+}
+
+// Remove unlinks the node from anywhere in the queue
+func (q *Queue[T]) Remove(node *Node[T]) {
+	if node.prev != nil {
+		node.prev.next = node.next
+	} else {
+		q.head = node.next
+	}
+
+	if node.next != nil {
+		node.next.prev = node.prev
+	} else {
+		q.tail = node.prev
+	}
 
 	node.next = nil
 	node.prev = nil
-	node = nil
 
-	return q
+	q.len--
+}
+
+// MoveToBack moves the node to the back of the queue
+func (q *Queue[T]) MoveToBack(node *Node[T]) {
+	if q.tail == node {
+		return
+	}
+
+	q.Remove(node)
+	q.pushNode(node)
+}
+
+func (q *Queue[T]) Len() int {
+	return q.len
 }
 
 func (q *Queue[T]) Head() *Node[T] {
@@ -63,21 +109,83 @@ func NewQueue[T any]() *Queue[T] {
 
 type ServerCmd struct {
 	Command   string
-	DataBlock string
+	DataBlock []byte
 }
 
 type DataArgs struct {
 	Key       string
-	DataBlock string
+	DataBlock []byte
 	Flags     int
 	Exptime   int64
 	ByteCt    int
 	Noreply   bool
+	Cas       uint64
+	// Time is the unix time the item was last stored at
+	Time int64
+	// Stale is set when the item has been invalidated with the meta protocol
+	Stale bool
+	// WinSent is set once a client has been told with the W flag that it should refill the item
+	WinSent bool
+	// node is the position of the item in the LRU queue of the store
+	node *Node[string]
+	// size is the amount of bytes the item was accounted with when it was stored
+	size int64
+	// chunk holds the key and the value of the item, it belongs to the slab class
+	chunk slabChunk
+	class *SlabClass
+}
+
+// Stats holds the counters of the store that are reported by the stats command
+type Stats struct {
+	CmdGet      atomic.Uint64
+	CmdSet      atomic.Uint64
+	CmdFlush    atomic.Uint64
+	CmdTouch    atomic.Uint64
+	GetHits     atomic.Uint64
+	GetMisses   atomic.Uint64
+	DeleteHits  atomic.Uint64
+	DeleteMiss  atomic.Uint64
+	IncrHits    atomic.Uint64
+	IncrMisses  atomic.Uint64
+	DecrHits    atomic.Uint64
+	DecrMisses  atomic.Uint64
+	CasHits     atomic.Uint64
+	CasMisses   atomic.Uint64
+	CasBadval   atomic.Uint64
+	TouchHits   atomic.Uint64
+	TouchMisses atomic.Uint64
+	Evictions   atomic.Uint64
+	TotalItems  atomic.Uint64
+	// CrawlerStarts is the amount of sweeps the expiry crawler has started
+	CrawlerStarts atomic.Uint64
+	// CrawlerReclaimed is the amount of expired items the expiry crawler has removed
+	CrawlerReclaimed atomic.Uint64
 }
 
+// Store is the in-memory Storage, it holds the items in shards that are picked by the hash of the key
 type Store struct {
-	Db   *map[string]*DataArgs
-	Size int
+	shards []*shard
+	config StoreConfig
+	stats  Stats
+	// casUnique is the last cas unique that was handed out to an item
+	casUnique uint64
+	// oldestLive is the unix time of a delayed flush_all, items stored before it are invalid once it has passed.
+	// It is only written while every shard is locked
+	oldestLive int64
+	// crawlShard is the index of the shard the expiry crawler is sweeping
+	crawlShard int
+}
+
+// Peer is a client that is connected to the server
+type Peer struct {
+	Name        string
+	Conn        net.Conn
+	ConnectedAt time.Time
+	// LastCmdAt is the time the last command of the client was read
+	LastCmdAt time.Time
+	// Busy is set while a command of the client is executing, idle clients are disconnected right away
+	// when the server shuts down
+	Busy bool
 }
 
 type Message struct {